@@ -61,9 +61,22 @@ func main() {
 	log.Printf("  Ephemeral: %t", cfg.Ephemeral)
 	log.Printf("  Hosts file: %s", cfg.HostsFile)
 	log.Printf("  Forward to: %s", cfg.ForwardTo)
+	if cfg.Fallthrough {
+		if len(cfg.FallthroughZones) > 0 {
+			log.Printf("  Fallthrough: %s", strings.Join(cfg.FallthroughZones, ", "))
+		} else {
+			log.Printf("  Fallthrough: all domains")
+		}
+	}
 	if cfg.RewriteFile != "" {
 		log.Printf("  Rewrite file: %s", cfg.RewriteFile)
 	}
+	if cfg.SnapshotFile != "" {
+		log.Printf("  Snapshot file: %s", cfg.SnapshotFile)
+	}
+	if len(cfg.DNSSECKeys) > 0 {
+		log.Printf("  DNSSEC keys: %s", strings.Join(cfg.DNSSECKeys, ", "))
+	}
 	log.Printf("  Refresh interval: %d seconds", cfg.RefreshInterval)
 
 	// Generate Corefile
@@ -170,7 +183,10 @@ Environment Variables:
   TS_HOSTS_FILE        Path to custom hosts file (optional)
   TS_REWRITE_FILE      Path to rewrite rules file (optional)
   TS_FORWARD_TO        Forward server for unresolved queries (default: /etc/resolv.conf)
+  TS_FALLTHROUGH       Pass unknown names to the forward server: true or comma-separated domains (default: false)
   TS_EPHEMERAL         Enable ephemeral mode (default: true)
+  TS_SNAPSHOT_FILE     File the records are persisted to for warm starts, or false (default: /state/records.json)
+  TS_DNSSEC_KEYS       Comma-separated base paths of DNSSEC key files signing the domains (optional)
   TSC_REFRESH_INTERVAL Refresh interval in seconds (default: 30)
 
 `, os.Args[0])
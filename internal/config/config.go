@@ -22,6 +22,18 @@ type Config struct {
 	ForwardTo   string
 	RewriteFile string
 
+	// Fallthrough passes unknown names to the next plugin instead of
+	// answering NXDOMAIN. An empty FallthroughZones list means all domains.
+	Fallthrough      bool
+	FallthroughZones []string
+
+	// SnapshotFile persists the records for warm starts; empty disables it
+	SnapshotFile string
+
+	// DNSSECKeys are the base paths of the key files signing the domains;
+	// empty disables DNSSEC
+	DNSSECKeys []string
+
 	// Split DNS settings
 	EnableSplitDNS bool
 	Tailnet        string
@@ -90,6 +102,38 @@ func LoadFromEnv() (*Config, error) {
 	// Optional: Rewrite file
 	config.RewriteFile = os.Getenv("TS_REWRITE_FILE")
 
+	// Optional: Fallthrough for unknown names ("true" for all domains or a comma-separated list)
+	if fallthroughStr := strings.TrimSpace(os.Getenv("TS_FALLTHROUGH")); fallthroughStr != "" {
+		switch strings.ToLower(fallthroughStr) {
+		case "true":
+			config.Fallthrough = true
+		case "false":
+		default:
+			zones, err := api.ParseDomains(fallthroughStr)
+			if err != nil {
+				return nil, fmt.Errorf("invalid TS_FALLTHROUGH value: %w", err)
+			}
+			config.Fallthrough = true
+			config.FallthroughZones = zones
+		}
+	}
+
+	// Optional: Record snapshot ("false" disables it)
+	config.SnapshotFile = strings.TrimSpace(os.Getenv("TS_SNAPSHOT_FILE"))
+	switch strings.ToLower(config.SnapshotFile) {
+	case "":
+		config.SnapshotFile = "/state/records.json"
+	case "false":
+		config.SnapshotFile = ""
+	}
+
+	// Optional: DNSSEC keys (comma-separated base paths of dnssec-keygen files)
+	for _, key := range strings.Split(os.Getenv("TS_DNSSEC_KEYS"), ",") {
+		if key = strings.TrimSpace(key); key != "" {
+			config.DNSSECKeys = append(config.DNSSECKeys, key)
+		}
+	}
+
 	// Optional: Split DNS
 	config.EnableSplitDNS = strings.ToLower(os.Getenv("TS_ENABLE_SPLIT_DNS")) == "true"
 
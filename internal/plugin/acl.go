@@ -0,0 +1,217 @@
+package plugin
+
+import (
+	"context"
+	"net/netip"
+	"slices"
+	"strings"
+
+	clog "github.com/coredns/coredns/plugin/pkg/log"
+	"github.com/coredns/coredns/request"
+	"tailscale.com/tailcfg"
+)
+
+// Node patterns of a grant beyond the selectors.
+const (
+	grantAll  = "*"              // every node
+	grantSelf = "autogroup:self" // nodes owned by the querier's owner
+)
+
+// aclGrant is a value of the capability that the tailnet policy grants a
+// querier on the ts-dns node, listing the nodes it may resolve:
+//
+//	{"nodes": ["tag:prod", "autogroup:self"]}
+type aclGrant struct {
+	Nodes []string `json:"nodes"`
+}
+
+// view is the part of the tailnet a querier may resolve. A nil view sees every node.
+type view struct {
+	node      string         // stable ID of the querier's node
+	user      string         // login name of the querier's owner; empty for tagged nodes
+	all       bool           // granted every node
+	self      bool           // granted the nodes of its owner
+	members   bool           // granted every untagged node
+	tagged    bool           // granted every tagged node
+	selectors []selector     // granted nodes
+	prefixes  []netip.Prefix // granted addresses
+	lan       bool           // querier is outside the tailnet and gets LAN addresses
+}
+
+// viewFor returns the view of the source of a query, or nil when neither
+// ACL-aware nor split-horizon answers are enabled.
+func (t *Tailscale) viewFor(ctx context.Context, state request.Request) *view {
+	addr, err := netip.ParseAddr(state.IP())
+	if err != nil {
+		return t.aclView(ctx, netip.Addr{})
+	}
+	addr = addr.Unmap()
+	v := t.aclView(ctx, addr)
+
+	// Clients outside the tailnet are answered with LAN addresses
+	if t.lan.enabled() && !isTailnetIP(addr) {
+		if v == nil {
+			v = &view{all: true}
+		}
+		v.lan = true
+	}
+	return v
+}
+
+// aclView returns the nodes the querier at addr is granted, or nil when
+// ACL-aware answers are disabled. Sources that tailscaled cannot identify see
+// no nodes, unless acl_unidentified allows them every node.
+func (t *Tailscale) aclView(ctx context.Context, addr netip.Addr) *view {
+	if !t.aclEnabled() {
+		return nil
+	}
+	if !addr.IsValid() {
+		return t.unidentifiedView()
+	}
+	who := t.whois.identify(ctx, addr)
+	if who == nil || who.Node == nil {
+		return t.unidentifiedView()
+	}
+
+	v := &view{node: string(who.Node.StableID)}
+	if !who.Node.IsTagged() && who.UserProfile != nil {
+		v.user = who.UserProfile.LoginName
+	}
+
+	if t.aclPolicy {
+		t.mu.RLock()
+		policy := t.policy
+		t.mu.RUnlock()
+		policy.grant(v, who)
+		return v
+	}
+
+	grants, err := tailcfg.UnmarshalCapJSON[aclGrant](who.CapMap, t.aclCapability)
+	if err != nil {
+		clog.Warningf("ignoring invalid %s grant of %s: %v", t.aclCapability, who.Node.Name, err)
+		return v
+	}
+	for _, grant := range grants {
+		for _, pattern := range grant.Nodes {
+			switch strings.ToLower(pattern) {
+			case grantAll:
+				v.all = true
+			case grantSelf:
+				v.self = true
+			default:
+				sel, err := parseSelector(pattern)
+				if err != nil {
+					clog.Warningf("ignoring node pattern of %s grant: %v", t.aclCapability, err)
+					continue
+				}
+				v.selectors = append(v.selectors, sel)
+			}
+		}
+	}
+	return v
+}
+
+// aclEnabled reports whether answers depend on the querier's identity.
+func (t *Tailscale) aclEnabled() bool {
+	return t.aclCapability != "" || t.aclPolicy
+}
+
+// unidentifiedView returns the view of queriers that are not tailnet nodes.
+func (t *Tailscale) unidentifiedView() *view {
+	if t.aclAllowUnidentified {
+		return nil
+	}
+	return &view{}
+}
+
+// allowsNode reports whether the view includes node. The querier always sees itself.
+func (v *view) allowsNode(node nodeIdentity) bool {
+	if v == nil || v.all || (v.node != "" && node.ID == v.node) {
+		return true
+	}
+	if v.self && v.user != "" && len(node.Tags) == 0 && strings.EqualFold(node.User, v.user) {
+		return true
+	}
+	if (v.members && len(node.Tags) == 0) || (v.tagged && len(node.Tags) > 0) {
+		return true
+	}
+	for _, sel := range v.selectors {
+		if sel.matchesNode(node) {
+			return true
+		}
+	}
+	return false
+}
+
+// allowsAddr reports whether the view includes the node owning addr.
+// Addresses that belong to no node, such as those of external targets, are visible.
+func (v *view) allowsAddr(table *recordTable, addr netip.Addr) bool {
+	if v == nil || slices.ContainsFunc(v.prefixes, func(p netip.Prefix) bool { return p.Contains(addr) }) {
+		return true
+	}
+	node, ok := table.Nodes[addr]
+	return !ok || v.allowsNode(node)
+}
+
+// filter returns the addresses of rec that the view includes. Views outside
+// the tailnet get the LAN addresses of nodes that have them instead.
+func (v *view) filter(table *recordTable, rec record) record {
+	if v == nil {
+		return rec
+	}
+	var addrs []netip.Addr
+	for _, addr := range rec.Addrs {
+		if !v.allowsAddr(table, addr) {
+			continue
+		}
+		if node := table.Nodes[addr]; v.lan && len(node.LAN) > 0 {
+			for _, lan := range node.LAN {
+				if !slices.Contains(addrs, lan) {
+					addrs = append(addrs, lan)
+				}
+			}
+			continue
+		}
+		addrs = append(addrs, addr)
+	}
+	return record{Addrs: addrs}
+}
+
+// allowsName reports whether the node or service group name has an address in
+// the view. Other names are visible.
+func (v *view) allowsName(table *recordTable, name string) bool {
+	rec, ok := table.Records[name]
+	if !ok {
+		rec, ok = table.Groups[name]
+	}
+	if !ok || v == nil || len(rec.Addrs) == 0 {
+		return true
+	}
+	return len(v.filter(table, rec).Addrs) > 0
+}
+
+// allowsAlias reports whether the final target of the alias name is visible.
+func (v *view) allowsAlias(table *recordTable, name string) bool {
+	for i := 0; i < maxAliasChain; i++ {
+		target, ok := table.Aliases[name]
+		if !ok {
+			break
+		}
+		name = target
+	}
+	return v.allowsName(table, name)
+}
+
+// services returns the targets of a service that the view includes.
+func (v *view) services(table *recordTable, targets []srvTarget) []srvTarget {
+	if v == nil {
+		return targets
+	}
+	var visible []srvTarget
+	for _, target := range targets {
+		if v.allowsName(table, target.Target) {
+			visible = append(visible, target)
+		}
+	}
+	return visible
+}
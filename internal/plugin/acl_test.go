@@ -0,0 +1,280 @@
+package plugin
+
+import (
+	"context"
+	"errors"
+	"net/netip"
+	"testing"
+
+	"github.com/coredns/coredns/plugin/pkg/dnstest"
+	"github.com/coredns/coredns/plugin/test"
+	"github.com/miekg/dns"
+	"tailscale.com/client/tailscale/apitype"
+	"tailscale.com/tailcfg"
+)
+
+// testCapability is the capability granting nodes to queriers in tests.
+const testCapability = "example.com/cap/ts-dns"
+
+// testWhois identifies 100.64.0.9 as a node granted the nodes of grant.
+func testWhois(grant string) whoisFunc {
+	return func(ctx context.Context, addr string) (*apitype.WhoIsResponse, error) {
+		if addr != "100.64.0.9" {
+			return nil, errors.New("no match for IP")
+		}
+		return &apitype.WhoIsResponse{
+			Node:        &tailcfg.Node{StableID: "querier", Name: "laptop.tailnet.ts.net."},
+			UserProfile: &tailcfg.UserProfile{LoginName: "alice@example.com"},
+			CapMap:      tailcfg.PeerCapMap{testCapability: {tailcfg.RawMessage(grant)}},
+		}, nil
+	}
+}
+
+// queryFrom sends a question from source and checks the rcode of the response.
+func queryFrom(t *testing.T, ts *Tailscale, source, qname string, qtype uint16, want int) *dns.Msg {
+	t.Helper()
+
+	req := new(dns.Msg)
+	req.SetQuestion(qname, qtype)
+
+	rec := dnstest.NewRecorder(&test.ResponseWriter{RemoteIP: source})
+	if _, err := ts.ServeDNS(context.Background(), rec, req); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if rec.Msg == nil {
+		t.Fatalf("Expected a response for %s", qname)
+	}
+	if rec.Msg.Rcode != want {
+		t.Fatalf("Expected rcode %d for %s but got %d", want, qname, rec.Msg.Rcode)
+	}
+	return rec.Msg
+}
+
+func TestServeDNSACL(t *testing.T) {
+	ts := newTestTailscale([]string{"example.com"}, testStatus(), func(ts *Tailscale) {
+		ts.aclCapability = testCapability
+		ts.whois = newWhoisCache(testWhois(`{"nodes": ["tag:srv-postgres-tcp-5432"]}`))
+	})
+
+	tests := []struct {
+		name    string
+		qname   string
+		qtype   uint16
+		rcode   int
+		answers []string
+	}{
+		{
+			name:    "granted node",
+			qname:   "db.example.com.",
+			qtype:   dns.TypeA,
+			rcode:   dns.RcodeSuccess,
+			answers: []string{"db.example.com.\t60\tIN\tA\t100.64.0.3"},
+		},
+		{
+			name:  "hidden node",
+			qname: "web.example.com.",
+			qtype: dns.TypeA,
+			rcode: dns.RcodeNameError,
+		},
+		{
+			name:  "alias of a hidden node",
+			qname: "app.example.com.",
+			qtype: dns.TypeA,
+			rcode: dns.RcodeNameError,
+		},
+		{
+			name:  "service group of hidden nodes",
+			qname: "frontend.example.com.",
+			qtype: dns.TypeA,
+			rcode: dns.RcodeNameError,
+		},
+		{
+			name:    "service offered by a hidden and a granted node",
+			qname:   "_http._tcp.example.com.",
+			qtype:   dns.TypeSRV,
+			rcode:   dns.RcodeSuccess,
+			answers: []string{"_http._tcp.example.com.\t60\tIN\tSRV\t10 10 80 db.example.com.", "_http._tcp.example.com.\t60\tIN\tSRV\t10 10 8080 db.example.com."},
+		},
+		{
+			name:  "reverse lookup of a hidden node",
+			qname: "2.0.64.100.in-addr.arpa.",
+			qtype: dns.TypePTR,
+			rcode: dns.RcodeNameError,
+		},
+		{
+			name:    "reverse lookup of a granted node",
+			qname:   "3.0.64.100.in-addr.arpa.",
+			qtype:   dns.TypePTR,
+			rcode:   dns.RcodeSuccess,
+			answers: []string{"3.0.64.100.in-addr.arpa.\t60\tIN\tPTR\tdb.example.com."},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			m := queryFrom(t, ts, "100.64.0.9", tt.qname, tt.qtype, tt.rcode)
+			checkSection(t, "answer", m.Answer, tt.answers)
+		})
+	}
+
+	// Hidden addresses are denied with the SOA of their reverse zone, like other missing names
+	for _, qname := range []string{"2.0.64.100.in-addr.arpa.", "2.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.e.1.a.c.5.1.1.a.7.d.f.ip6.arpa."} {
+		m := queryFrom(t, ts, "100.64.0.9", qname, dns.TypePTR, dns.RcodeNameError)
+		if len(m.Ns) != 1 || m.Ns[0].Header().Rrtype != dns.TypeSOA || !dns.IsSubDomain(m.Ns[0].Header().Name, qname) {
+			t.Errorf("Expected the SOA of the reverse zone of %s but got %v", qname, m.Ns)
+		}
+	}
+}
+
+func TestServeDNSACLQueriers(t *testing.T) {
+	tests := []struct {
+		name         string
+		grant        string
+		source       string
+		unidentified bool
+		rcode        int
+	}{
+		{name: "every node granted", grant: `{"nodes": ["*"]}`, source: "100.64.0.9", rcode: dns.RcodeSuccess},
+		{name: "no node granted", grant: `{"nodes": []}`, source: "100.64.0.9", rcode: dns.RcodeNameError},
+		{name: "unidentified source denied", source: "192.0.2.1", rcode: dns.RcodeNameError},
+		{name: "unknown tailnet source denied", source: "100.64.0.10", rcode: dns.RcodeNameError},
+		{name: "unidentified source allowed", source: "192.0.2.1", unidentified: true, rcode: dns.RcodeSuccess},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ts := newTestTailscale([]string{"example.com"}, testStatus(), func(ts *Tailscale) {
+				ts.aclCapability = testCapability
+				ts.aclAllowUnidentified = tt.unidentified
+				ts.whois = newWhoisCache(testWhois(tt.grant))
+			})
+			queryFrom(t, ts, tt.source, "web.example.com.", dns.TypeA, tt.rcode)
+
+			// The apex stays visible to everyone
+			queryFrom(t, ts, tt.source, "example.com.", dns.TypeSOA, dns.RcodeSuccess)
+		})
+	}
+}
+
+func TestServeDNSACLDNSSEC(t *testing.T) {
+	tests := []struct {
+		name   string
+		grant  string
+		qname  string
+		qtype  uint16
+		rcode  int
+		hidden []string
+	}{
+		{
+			name:   "hidden node",
+			grant:  `{"nodes": ["tag:srv-postgres-tcp-5432"]}`,
+			qname:  "web.example.com.",
+			qtype:  dns.TypeA,
+			rcode:  dns.RcodeNameError,
+			hidden: []string{"web.example.com."},
+		},
+		{
+			name:   "name below a hidden node",
+			grant:  `{"nodes": ["tag:srv-postgres-tcp-5432"]}`,
+			qname:  "x.web.example.com.",
+			qtype:  dns.TypeA,
+			rcode:  dns.RcodeNameError,
+			hidden: []string{"web.example.com."},
+		},
+		{
+			name:   "empty non-terminal of hidden services",
+			grant:  `{"nodes": []}`,
+			qname:  "_tcp.example.com.",
+			qtype:  dns.TypeSRV,
+			rcode:  dns.RcodeNameError,
+			hidden: []string{"_tcp.example.com.", "_http._tcp.example.com."},
+		},
+		{
+			name:  "empty non-terminal of a granted service",
+			grant: `{"nodes": ["tag:srv-postgres-tcp-5432"]}`,
+			qname: "_tcp.example.com.",
+			qtype: dns.TypeSRV,
+			rcode: dns.RcodeSuccess,
+		},
+	}
+
+	for _, method := range []string{denialNSEC, denialNSEC3} {
+		for _, tt := range tests {
+			t.Run(method+" "+tt.name, func(t *testing.T) {
+				ts := newSignedTailscale(t, method)
+				ts.aclCapability = testCapability
+				ts.whois = newWhoisCache(testWhois(tt.grant))
+
+				m := querySignedFrom(t, ts, "100.64.0.9", tt.qname, tt.qtype, tt.rcode)
+				checkSigned(t, ts, m.Ns)
+				for _, name := range tt.hidden {
+					for _, rr := range m.Ns {
+						if reveals(rr, name) {
+							t.Errorf("Expected no proof revealing %s but got %s", name, rr)
+						}
+					}
+				}
+			})
+		}
+	}
+}
+
+// reveals reports whether a denial record proves that name exists.
+func reveals(rr dns.RR, name string) bool {
+	switch rr := rr.(type) {
+	case *dns.NSEC3:
+		return rr.Match(name)
+	case *dns.NSEC:
+		return rr.Hdr.Name == name || rr.NextDomain == `\000.*.`+name
+	}
+	return false
+}
+
+func TestViewSelf(t *testing.T) {
+	v := &view{node: "n1", user: "alice@example.com", self: true}
+
+	tests := []struct {
+		name     string
+		node     nodeIdentity
+		expected bool
+	}{
+		{name: "querier itself", node: nodeIdentity{ID: "n1"}, expected: true},
+		{name: "device of the same owner", node: nodeIdentity{ID: "n2", User: "Alice@example.com"}, expected: true},
+		{name: "tagged device of the same owner", node: nodeIdentity{ID: "n3", User: "alice@example.com", Tags: []string{"tag:server"}}, expected: false},
+		{name: "device of another owner", node: nodeIdentity{ID: "n4", User: "bob@example.com"}, expected: false},
+	}
+
+	for _, tt := range tests {
+		if got := v.allowsNode(tt.node); got != tt.expected {
+			t.Errorf("%s: expected %v but got %v", tt.name, tt.expected, got)
+		}
+	}
+}
+
+func TestWhoisCache(t *testing.T) {
+	lookups := 0
+	c := newWhoisCache(func(ctx context.Context, addr string) (*apitype.WhoIsResponse, error) {
+		lookups++
+		return testWhois(`{}`)(ctx, addr)
+	})
+
+	for range 3 {
+		if who := c.identify(context.Background(), netip.MustParseAddr("100.64.0.9")); who == nil || who.Node.StableID != "querier" {
+			t.Fatalf("Expected the querier node but got %v", who)
+		}
+	}
+	if lookups != 1 {
+		t.Errorf("Expected 1 lookup but got %d", lookups)
+	}
+
+	// Addresses outside the tailnet are not looked up
+	if who := c.identify(context.Background(), netip.MustParseAddr("192.0.2.1")); who != nil || lookups != 1 {
+		t.Errorf("Expected no identity and no lookup but got %v after %d lookups", who, lookups)
+	}
+
+	c.clear()
+	c.identify(context.Background(), netip.MustParseAddr("100.64.0.9"))
+	if lookups != 2 {
+		t.Errorf("Expected 2 lookups after clearing but got %d", lookups)
+	}
+}
@@ -0,0 +1,548 @@
+package plugin
+
+import (
+	"context"
+	"crypto"
+	"encoding/base32"
+	"fmt"
+	"hash/fnv"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/coredns/coredns/plugin"
+	"github.com/coredns/coredns/plugin/metrics"
+	"github.com/coredns/coredns/plugin/pkg/cache"
+	clog "github.com/coredns/coredns/plugin/pkg/log"
+	"github.com/coredns/coredns/request"
+	"github.com/miekg/dns"
+)
+
+// Denial of existence methods accepted by the dnssec_denial option.
+const (
+	denialNSEC  = "nsec"
+	denialNSEC3 = "nsec3"
+)
+
+// Signatures are valid from signatureInception before they are made, to
+// tolerate clock skew, until signatureValidity after. Cached signatures are
+// replaced when less than signatureRenewal of their validity is left.
+const (
+	signatureInception = 3 * time.Hour
+	signatureValidity  = 8 * 24 * time.Hour
+	signatureRenewal   = 2 * 24 * time.Hour
+	signatureCacheSize = 10000
+)
+
+// nsec3Encoding is the base32 encoding of hashed NSEC3 owner names.
+var nsec3Encoding = base32.HexEncoding.WithPadding(base32.NoPadding)
+
+// signingKey is a DNSSEC key pair read from the files written by dnssec-keygen.
+type signingKey struct {
+	dnskey *dns.DNSKEY
+	signer crypto.Signer
+}
+
+// readSigningKey reads the key pair stored in base.key and base.private. The
+// zone the key signs is the owner name of its DNSKEY record.
+func readSigningKey(base string) (*signingKey, error) {
+	base = strings.TrimSuffix(strings.TrimSuffix(base, ".key"), ".private")
+
+	pub, err := os.Open(filepath.Clean(base + ".key"))
+	if err != nil {
+		return nil, err
+	}
+	defer pub.Close()
+
+	rr, err := dns.ReadRR(pub, base+".key")
+	if err != nil {
+		return nil, fmt.Errorf("failed to read public key %s.key: %w", base, err)
+	}
+	dnskey, ok := rr.(*dns.DNSKEY)
+	if !ok {
+		return nil, fmt.Errorf("%s.key does not contain a DNSKEY record", base)
+	}
+	dnskey.Hdr.Name = strings.ToLower(dnskey.Hdr.Name)
+
+	priv, err := os.Open(filepath.Clean(base + ".private"))
+	if err != nil {
+		return nil, err
+	}
+	defer priv.Close()
+
+	key, err := dnskey.ReadPrivateKey(priv, base+".private")
+	if err != nil {
+		return nil, fmt.Errorf("failed to read private key %s.private: %w", base, err)
+	}
+	signer, ok := key.(crypto.Signer)
+	if !ok {
+		return nil, fmt.Errorf("unsupported private key in %s.private", base)
+	}
+	return &signingKey{dnskey: dnskey, signer: signer}, nil
+}
+
+// isKSK reports whether the key has the secure entry point flag.
+func (k *signingKey) isKSK() bool {
+	return k.dnskey.Flags&dns.SEP != 0
+}
+
+// zoneSigner signs the answers of the zones it holds keys for.
+type zoneSigner struct {
+	zones   []string                 // zones with keys and the configured zones, to find the zone of a name
+	reverse []string                 // reverse zones with keys, answered authoritatively
+	keys    map[string][]*signingKey // zone -> keys
+	method  string                   // denial of existence method, nsec or nsec3
+	cache   *cache.Cache             // RRset hash -> signatures
+}
+
+// newZoneSigner returns a signer without keys.
+func newZoneSigner() *zoneSigner {
+	return &zoneSigner{
+		keys:   make(map[string][]*signingKey),
+		method: denialNSEC,
+		cache:  cache.New(signatureCacheSize),
+	}
+}
+
+// addKey adds a key to the zone named by its DNSKEY record.
+func (s *zoneSigner) addKey(key *signingKey) {
+	zone := key.dnskey.Hdr.Name
+	if isTailnetReverseZone(zone) && !slices.Contains(s.reverse, zone) {
+		s.reverse = append(s.reverse, zone)
+	}
+	s.addZone(zone)
+	s.keys[zone] = append(s.keys[zone], key)
+}
+
+// reverseZone returns the signed reverse zone containing name, or an empty
+// string. It is safe on a nil signer.
+func (s *zoneSigner) reverseZone(name string) string {
+	if s == nil {
+		return ""
+	}
+	return plugin.Zones(s.reverse).Matches(name)
+}
+
+// addZone registers a zone, so that names in it are not signed with the keys
+// of an enclosing zone.
+func (s *zoneSigner) addZone(zone string) {
+	if !slices.Contains(s.zones, zone) {
+		s.zones = append(s.zones, zone)
+	}
+}
+
+// signingKeys returns the keys that sign RRsets of rrtype in zone. When the
+// zone has both key and zone signing keys, the key signing keys only sign the
+// DNSKEY RRset and the zone signing keys sign everything else.
+func (s *zoneSigner) signingKeys(zone string, rrtype uint16) []*signingKey {
+	keys := s.keys[zone]
+	var ksks, zsks []*signingKey
+	for _, key := range keys {
+		if key.isKSK() {
+			ksks = append(ksks, key)
+		} else {
+			zsks = append(zsks, key)
+		}
+	}
+	if len(ksks) == 0 || len(zsks) == 0 {
+		return keys
+	}
+	if rrtype == dns.TypeDNSKEY {
+		return ksks
+	}
+	return zsks
+}
+
+// dnskeys returns the DNSKEY RRset of zone.
+func (s *zoneSigner) dnskeys(zone string, ttl uint32) []dns.RR {
+	var rrs []dns.RR
+	for _, key := range s.keys[zone] {
+		rr := dns.Copy(key.dnskey)
+		rr.Header().Ttl = ttl
+		rrs = append(rrs, rr)
+	}
+	return rrs
+}
+
+// logDS logs the DS records to publish in the parent zones. Only key signing
+// keys are delegated to, unless a zone has none.
+func (s *zoneSigner) logDS() {
+	for _, zone := range s.zones {
+		for _, key := range s.signingKeys(zone, dns.TypeDNSKEY) {
+			clog.Infof("DS record for %s: %s", zone, key.dnskey.ToDS(dns.SHA256))
+		}
+	}
+}
+
+// sign adds the signatures of every RRset of m that belongs to a zone with keys.
+func (s *zoneSigner) sign(m *dns.Msg, now time.Time) {
+	m.Answer = s.signSection(m.Answer, now)
+	m.Ns = s.signSection(m.Ns, now)
+	m.Extra = s.signSection(m.Extra, now)
+}
+
+// signSection appends the signatures of the RRsets in rrs.
+func (s *zoneSigner) signSection(rrs []dns.RR, now time.Time) []dns.RR {
+	for _, set := range rrSets(rrs) {
+		rrs = append(rrs, s.signRRset(set, now)...)
+	}
+	return rrs
+}
+
+// signRRset returns the signatures of rrs made with the keys of its zone.
+// Signatures are cached until they approach their expiration.
+func (s *zoneSigner) signRRset(rrs []dns.RR, now time.Time) []dns.RR {
+	zone := plugin.Zones(s.zones).Matches(rrs[0].Header().Name)
+	keys := s.signingKeys(zone, rrs[0].Header().Rrtype)
+	if len(keys) == 0 {
+		return nil
+	}
+
+	hash := rrsetHash(rrs)
+	if cached, ok := s.cache.Get(hash); ok {
+		sigs := cached.([]dns.RR)
+		if signaturesValid(sigs, now.Add(signatureRenewal)) {
+			return sigs
+		}
+	}
+
+	sigs := make([]dns.RR, 0, len(keys))
+	for _, key := range keys {
+		sig := &dns.RRSIG{
+			Hdr:        dns.RR_Header{Ttl: rrs[0].Header().Ttl},
+			Algorithm:  key.dnskey.Algorithm,
+			KeyTag:     key.dnskey.KeyTag(),
+			SignerName: zone,
+			Inception:  uint32(now.Add(-signatureInception).Unix()),
+			Expiration: uint32(now.Add(signatureValidity).Unix()),
+		}
+		if err := sig.Sign(key.signer, rrs); err != nil {
+			clog.Warningf("failed to sign %s %s: %v", rrs[0].Header().Name, dns.TypeToString[rrs[0].Header().Rrtype], err)
+			return nil
+		}
+		sigs = append(sigs, sig)
+	}
+	s.cache.Add(hash, sigs)
+	return sigs
+}
+
+// signaturesValid reports whether every signature is valid at time t.
+func signaturesValid(sigs []dns.RR, t time.Time) bool {
+	for _, sig := range sigs {
+		if !sig.(*dns.RRSIG).ValidityPeriod(t) {
+			return false
+		}
+	}
+	return true
+}
+
+// rrsetKey identifies an RRset within a message section.
+type rrsetKey struct {
+	name   string
+	rrtype uint16
+}
+
+// rrSets groups the records of a section into RRsets, in order of appearance.
+// Signatures and the OPT pseudo-record are left out.
+func rrSets(rrs []dns.RR) [][]dns.RR {
+	var sets [][]dns.RR
+	index := make(map[rrsetKey]int)
+	for _, rr := range rrs {
+		hdr := rr.Header()
+		if hdr.Rrtype == dns.TypeRRSIG || hdr.Rrtype == dns.TypeOPT {
+			continue
+		}
+		key := rrsetKey{name: strings.ToLower(hdr.Name), rrtype: hdr.Rrtype}
+		if i, ok := index[key]; ok {
+			sets[i] = append(sets[i], rr)
+			continue
+		}
+		index[key] = len(sets)
+		sets = append(sets, []dns.RR{rr})
+	}
+	return sets
+}
+
+// rrsetHash returns a hash of an RRset that does not depend on the order of
+// its records, which is shuffled for service groups.
+func rrsetHash(rrs []dns.RR) uint64 {
+	texts := make([]string, len(rrs))
+	for i, rr := range rrs {
+		texts[i] = rr.String()
+	}
+	slices.Sort(texts)
+
+	h := fnv.New64()
+	for _, text := range texts {
+		h.Write([]byte(text))
+	}
+	return h.Sum64()
+}
+
+// serveDNSKEY answers DNSKEY queries for the zones the plugin holds keys for,
+// including reverse zones.
+func (t *Tailscale) serveDNSKEY(ctx context.Context, w dns.ResponseWriter, r *dns.Msg, state request.Request) (int, error) {
+	_, _, ttl := t.current()
+
+	m := new(dns.Msg)
+	m.SetReply(r)
+	m.Authoritative = true
+	m.Answer = t.dnssec.dnskeys(state.Name(), ttl)
+	if state.Do() {
+		t.dnssec.sign(m, time.Now())
+	}
+
+	queryCount.WithLabelValues(metrics.WithServer(ctx), state.Type(), resultAnswered).Inc()
+	if err := w.WriteMsg(m); err != nil {
+		return dns.RcodeServerFailure, err
+	}
+	return dns.RcodeSuccess, nil
+}
+
+// denial returns the unsigned records proving that qname does not exist, or
+// has no records of the queried type, in zone. Denials are synthesized for
+// each query and cover only the queried name, so the zone cannot be walked.
+// Names outside the querier's view do not exist in the proofs either.
+func (s *zoneSigner) denial(table *recordTable, zone, qname string, nxdomain bool, ttl uint32, v *view) []dns.RR {
+	if len(s.keys[zone]) == 0 {
+		return nil
+	}
+	if s.method == denialNSEC3 {
+		return s.nsec3Denial(table, zone, qname, nxdomain, ttl, v)
+	}
+	return s.nsecDenial(table, zone, qname, nxdomain, ttl, v)
+}
+
+// types returns the record types that exist at name for the view, in
+// ascending order.
+func (s *zoneSigner) types(table *recordTable, zone, name string, v *view) []uint16 {
+	var types []uint16
+	rec, ok := table.Records[name]
+	if !ok {
+		rec = table.Groups[name]
+	}
+	rec = v.filter(table, rec)
+	if len(rec.ipv4()) > 0 {
+		types = append(types, dns.TypeA)
+	}
+	if name == zone && len(table.NS[zone]) > 0 {
+		types = append(types, dns.TypeNS)
+	}
+	if _, ok := table.Aliases[name]; ok && v.allowsAlias(table, name) {
+		types = append(types, dns.TypeCNAME)
+	}
+	if name == zone {
+		types = append(types, dns.TypeSOA)
+	}
+	if _, ok := table.PTRs[name]; ok && table.visible(name, v) {
+		types = append(types, dns.TypePTR)
+	}
+	if len(rec.ipv6()) > 0 {
+		types = append(types, dns.TypeAAAA)
+	}
+	if targets, ok := table.Services[name]; ok && len(v.services(table, targets)) > 0 {
+		types = append(types, dns.TypeSRV)
+	}
+	if name == zone && len(s.keys[zone]) > 0 {
+		types = append(types, dns.TypeDNSKEY)
+	}
+	return types
+}
+
+// nsecDenial proves a denial with minimally covering NSEC records (RFC 4470).
+// A missing type is denied by an NSEC record at qname. A missing name is denied
+// by NSEC records spanning only the next closer name and the wildcard of the
+// closest encloser, both directly below the encloser.
+func (s *zoneSigner) nsecDenial(table *recordTable, zone, qname string, nxdomain bool, ttl uint32, v *view) []dns.RR {
+	header := func(name string) dns.RR_Header {
+		return dns.RR_Header{Name: name, Rrtype: dns.TypeNSEC, Class: dns.ClassINET, Ttl: ttl}
+	}
+
+	if !nxdomain {
+		types := append(s.types(table, zone, qname, v), dns.TypeRRSIG, dns.TypeNSEC)
+		slices.Sort(types)
+		return []dns.RR{&dns.NSEC{Hdr: header(qname), NextDomain: `\000.` + qname, TypeBitMap: types}}
+	}
+
+	encloser, nextCloser := table.closestEncloser(zone, qname, v)
+	names := []string{nextCloser}
+	if wildcard := "*." + encloser; wildcard != nextCloser {
+		names = append(names, wildcard)
+	}
+
+	// Both ends stay at the level of the covered name, so the span does not
+	// imply that the name exists as an empty non-terminal
+	var rrs []dns.RR
+	for _, name := range names {
+		prev, ok := predecessor(name)
+		if !ok {
+			continue
+		}
+		next, ok := successor(name)
+		if !ok {
+			continue
+		}
+		rrs = append(rrs, &dns.NSEC{Hdr: header(prev), NextDomain: next, TypeBitMap: []uint16{dns.TypeRRSIG, dns.TypeNSEC}})
+	}
+	return rrs
+}
+
+// nsec3Denial proves a denial with NSEC3 records (RFC 5155) hashed without salt
+// or extra iterations, as recommended by RFC 9276. Records covering a hash span
+// only that hash, so they reveal no other hashes of the zone.
+func (s *zoneSigner) nsec3Denial(table *recordTable, zone, qname string, nxdomain bool, ttl uint32, v *view) []dns.RR {
+	match := func(name string) dns.RR {
+		types := s.types(table, zone, name, v)
+		if len(types) > 0 {
+			types = append(types, dns.TypeRRSIG)
+			slices.Sort(types)
+		}
+		hash := nsec3Hash(name)
+		return newNSEC3(zone, hash, nsec3Step(hash, 1), types, ttl)
+	}
+	cover := func(name string) dns.RR {
+		hash := nsec3Hash(name)
+		return newNSEC3(zone, nsec3Step(hash, -1), nsec3Step(hash, 1), nil, ttl)
+	}
+
+	if !nxdomain {
+		return []dns.RR{match(qname)}
+	}
+
+	encloser, nextCloser := table.closestEncloser(zone, qname, v)
+	return []dns.RR{match(encloser), cover(nextCloser), cover("*." + encloser)}
+}
+
+// newNSEC3 returns an NSEC3 record of zone from the raw owner and next hashes.
+func newNSEC3(zone string, owner, next []byte, types []uint16, ttl uint32) *dns.NSEC3 {
+	return &dns.NSEC3{
+		Hdr:        dns.RR_Header{Name: strings.ToLower(nsec3Encoding.EncodeToString(owner)) + "." + zone, Rrtype: dns.TypeNSEC3, Class: dns.ClassINET, Ttl: ttl},
+		Hash:       dns.SHA1,
+		HashLength: uint8(len(next)),
+		NextDomain: nsec3Encoding.EncodeToString(next),
+		TypeBitMap: types,
+	}
+}
+
+// nsec3Hash returns the raw NSEC3 hash of name.
+func nsec3Hash(name string) []byte {
+	hash, _ := nsec3Encoding.DecodeString(dns.HashName(name, dns.SHA1, 0, ""))
+	return hash
+}
+
+// nsec3Step returns hash incremented by one, or decremented when delta is negative.
+func nsec3Step(hash []byte, delta int) []byte {
+	out := slices.Clone(hash)
+	for i := len(out) - 1; i >= 0; i-- {
+		if delta > 0 {
+			out[i]++
+			if out[i] != 0 {
+				break
+			}
+		} else {
+			out[i]--
+			if out[i] != 0xff {
+				break
+			}
+		}
+	}
+	return out
+}
+
+// closestEncloser returns the longest ancestor of qname in zone that exists for
+// the view, and the name one label below it on the way to qname.
+func (rt *recordTable) closestEncloser(zone, qname string, v *view) (encloser, nextCloser string) {
+	name := qname
+	for name != zone {
+		off, end := dns.NextLabel(name, 0)
+		if end {
+			break
+		}
+		parent := name[off:]
+		if parent == zone || rt.exists(parent, v) {
+			return parent, name
+		}
+		name = parent
+	}
+	return zone, qname
+}
+
+// predecessor returns a name that sorts just before name in canonical order
+// and is not expected to exist, for NSEC records covering name (RFC 4470). The
+// last octet of the first label is decremented and the label padded with \255
+// octets. It fails for labels ending in a zero octet.
+func predecessor(name string) (string, bool) {
+	buf := make([]byte, 256)
+	length, err := dns.PackDomainName(name, buf, 0, nil, false)
+	if err != nil || buf[0] == 0 {
+		return "", false
+	}
+
+	label := slices.Clone(buf[1 : 1+buf[0]])
+	last := label[len(label)-1]
+	if last == 0 {
+		return "", false
+	}
+	last--
+	// Uppercase letters sort as lowercase ones
+	if last >= 'A' && last <= 'Z' {
+		last = 'A' - 1
+	}
+	label[len(label)-1] = last
+
+	size := min(63, 254-(length-1-len(label)))
+	for len(label) < size {
+		label = append(label, 0xff)
+	}
+
+	off, _ := dns.NextLabel(name, 0)
+	return escapeLabel(label) + "." + name[off:], true
+}
+
+// successor returns a name at the same level that sorts just after name and
+// its descendants in canonical order, for NSEC records covering name. A zero
+// octet is appended to the first label, or its last octet is incremented when
+// the label is full. It fails when neither is possible.
+func successor(name string) (string, bool) {
+	buf := make([]byte, 256)
+	length, err := dns.PackDomainName(name, buf, 0, nil, false)
+	if err != nil || buf[0] == 0 {
+		return "", false
+	}
+
+	label := slices.Clone(buf[1 : 1+buf[0]])
+	for i, c := range label {
+		if c >= 'A' && c <= 'Z' {
+			label[i] = c + 'a' - 'A'
+		}
+	}
+	switch last := label[len(label)-1]; {
+	case len(label) < 63 && length < 255:
+		label = append(label, 0)
+	case last == 0xff:
+		return "", false
+	case last == 'A'-1:
+		// Uppercase letters sort as lowercase ones
+		label[len(label)-1] = 'Z' + 1
+	default:
+		label[len(label)-1] = last + 1
+	}
+
+	off, _ := dns.NextLabel(name, 0)
+	return escapeLabel(label) + "." + name[off:], true
+}
+
+// escapeLabel returns the presentation format of a label.
+func escapeLabel(label []byte) string {
+	var b strings.Builder
+	for _, c := range label {
+		if c >= 'a' && c <= 'z' || c >= '0' && c <= '9' || c == '-' || c == '_' {
+			b.WriteByte(c)
+		} else {
+			fmt.Fprintf(&b, `\%03d`, c)
+		}
+	}
+	return b.String()
+}
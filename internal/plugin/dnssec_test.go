@@ -0,0 +1,408 @@
+package plugin
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+
+	"github.com/coredns/coredns/plugin/pkg/dnstest"
+	"github.com/coredns/coredns/plugin/test"
+	"github.com/miekg/dns"
+)
+
+// writeTestKey generates a key pair for zone and writes it in the format of
+// dnssec-keygen, returning the base path of the files.
+func writeTestKey(t *testing.T, dir, zone string, flags uint16) string {
+	t.Helper()
+
+	key := &dns.DNSKEY{
+		Hdr:       dns.RR_Header{Name: zone, Rrtype: dns.TypeDNSKEY, Class: dns.ClassINET, Ttl: 3600},
+		Flags:     flags,
+		Protocol:  3,
+		Algorithm: dns.ECDSAP256SHA256,
+	}
+	priv, err := key.Generate(256)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	base := filepath.Join(dir, "K"+zone)
+	if err := os.WriteFile(base+".key", []byte(key.String()+"\n"), 0o600); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if err := os.WriteFile(base+".private", []byte(key.PrivateKeyString(priv)), 0o600); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	return base
+}
+
+// newSignedTailscale returns a plugin instance signing example.com and the
+// 64.100.in-addr.arpa. reverse zone.
+func newSignedTailscale(t *testing.T, method string) *Tailscale {
+	t.Helper()
+
+	dir := t.TempDir()
+	return newTestTailscale([]string{"example.com"}, testStatus(), func(ts *Tailscale) {
+		ts.dnssec = newZoneSigner()
+		ts.dnssec.method = method
+		for _, zone := range []string{"example.com.", "64.100.in-addr.arpa."} {
+			key, err := readSigningKey(writeTestKey(t, dir, zone, dns.ZONE))
+			if err != nil {
+				t.Fatalf("Unexpected error: %v", err)
+			}
+			ts.dnssec.addKey(key)
+		}
+		ts.dnssec.addZone("example.com.")
+	})
+}
+
+// querySigned sends a question with the DO bit set and checks the rcode.
+func querySigned(t *testing.T, ts *Tailscale, qname string, qtype uint16, want int) *dns.Msg {
+	t.Helper()
+	return querySignedFrom(t, ts, "", qname, qtype, want)
+}
+
+// querySignedFrom is like querySigned, sending the question from source.
+func querySignedFrom(t *testing.T, ts *Tailscale, source, qname string, qtype uint16, want int) *dns.Msg {
+	t.Helper()
+
+	req := new(dns.Msg)
+	req.SetQuestion(qname, qtype)
+	req.SetEdns0(4096, true)
+
+	rec := dnstest.NewRecorder(&test.ResponseWriter{RemoteIP: source})
+	if _, err := ts.ServeDNS(context.Background(), rec, req); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if rec.Msg == nil {
+		t.Fatalf("Expected a response for %s", qname)
+	}
+	if rec.Msg.Rcode != want {
+		t.Fatalf("Expected rcode %d but got %d", want, rec.Msg.Rcode)
+	}
+	return rec.Msg
+}
+
+// checkSigned verifies that every RRset of rrs is signed by a key of ts.
+func checkSigned(t *testing.T, ts *Tailscale, rrs []dns.RR) {
+	t.Helper()
+
+	for _, set := range rrSets(rrs) {
+		hdr := set[0].Header()
+		verified := false
+		for _, rr := range rrs {
+			sig, ok := rr.(*dns.RRSIG)
+			if !ok || sig.Hdr.Name != hdr.Name || sig.TypeCovered != hdr.Rrtype {
+				continue
+			}
+			for _, key := range ts.dnssec.keys[sig.SignerName] {
+				if sig.Verify(key.dnskey, set) == nil {
+					verified = true
+				}
+			}
+		}
+		if !verified {
+			t.Errorf("Expected a valid signature of %s %s", hdr.Name, dns.TypeToString[hdr.Rrtype])
+		}
+	}
+}
+
+// recordsOfType returns the records of rrs with type rrtype.
+func recordsOfType(rrs []dns.RR, rrtype uint16) []dns.RR {
+	var out []dns.RR
+	for _, rr := range rrs {
+		if rr.Header().Rrtype == rrtype {
+			out = append(out, rr)
+		}
+	}
+	return out
+}
+
+func TestReadSigningKey(t *testing.T) {
+	dir := t.TempDir()
+	base := writeTestKey(t, dir, "example.com.", dns.ZONE|dns.SEP)
+
+	for _, path := range []string{base, base + ".key", base + ".private"} {
+		key, err := readSigningKey(path)
+		if err != nil {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+		if key.dnskey.Hdr.Name != "example.com." || !key.isKSK() {
+			t.Errorf("Expected a key signing key for example.com. but got %s", key.dnskey)
+		}
+	}
+
+	if _, err := readSigningKey(filepath.Join(dir, "missing")); err == nil {
+		t.Error("Expected error for a missing key")
+	}
+}
+
+func TestServeDNSSEC(t *testing.T) {
+	ts := newSignedTailscale(t, denialNSEC)
+
+	// Positive answers carry signatures, also in the additional section
+	m := querySigned(t, ts, "web.example.com.", dns.TypeA, dns.RcodeSuccess)
+	if len(recordsOfType(m.Answer, dns.TypeRRSIG)) != 1 {
+		t.Fatalf("Expected one RRSIG in the answer but got %v", m.Answer)
+	}
+	checkSigned(t, ts, m.Answer)
+
+	m = querySigned(t, ts, "_http._tcp.example.com.", dns.TypeSRV, dns.RcodeSuccess)
+	checkSigned(t, ts, m.Answer)
+	checkSigned(t, ts, m.Extra)
+
+	m = querySigned(t, ts, "example.com.", dns.TypeSOA, dns.RcodeSuccess)
+	checkSigned(t, ts, m.Answer)
+
+	// Reverse lookups are signed with the key of the reverse zone
+	m = querySigned(t, ts, "2.0.64.100.in-addr.arpa.", dns.TypePTR, dns.RcodeSuccess)
+	checkSigned(t, ts, m.Answer)
+	if sigs := recordsOfType(m.Answer, dns.TypeRRSIG); len(sigs) != 1 || sigs[0].(*dns.RRSIG).SignerName != "64.100.in-addr.arpa." {
+		t.Errorf("Expected a signature by 64.100.in-addr.arpa. but got %v", sigs)
+	}
+
+	// The DNSKEY RRset is served for every zone with keys
+	for _, zone := range []string{"example.com.", "64.100.in-addr.arpa."} {
+		m = querySigned(t, ts, zone, dns.TypeDNSKEY, dns.RcodeSuccess)
+		if keys := recordsOfType(m.Answer, dns.TypeDNSKEY); len(keys) != 1 {
+			t.Errorf("Expected one DNSKEY for %s but got %v", zone, m.Answer)
+		}
+		checkSigned(t, ts, m.Answer)
+	}
+
+	// Queries without the DO bit are not signed
+	rec := query(t, ts, "web.example.com.", dns.TypeA, dns.RcodeSuccess)
+	if sigs := recordsOfType(rec.Msg.Answer, dns.TypeRRSIG); len(sigs) != 0 {
+		t.Errorf("Expected no RRSIG without DO but got %v", sigs)
+	}
+}
+
+func TestServeDNSSECDenialNSEC(t *testing.T) {
+	ts := newSignedTailscale(t, denialNSEC)
+
+	// A missing name is denied by NSEC records covering the next closer name
+	// and the wildcard, both spanning names directly below the closest encloser
+	tests := []struct {
+		qname    string
+		encloser string
+		next     []string
+	}{
+		{qname: "missing.example.com.", encloser: "example.com.", next: []string{`missing\000.example.com.`, `\042\000.example.com.`}},
+		{qname: "a.b.example.com.", encloser: "example.com.", next: []string{`b\000.example.com.`, `\042\000.example.com.`}},
+		{qname: "a.b.web.example.com.", encloser: "web.example.com.", next: []string{`b\000.web.example.com.`, `\042\000.web.example.com.`}},
+	}
+	for _, tt := range tests {
+		m := querySigned(t, ts, tt.qname, dns.TypeA, dns.RcodeNameError)
+		checkSigned(t, ts, m.Ns)
+		var next []string
+		for _, rr := range recordsOfType(m.Ns, dns.TypeNSEC) {
+			next = append(next, rr.(*dns.NSEC).NextDomain)
+			if off, _ := dns.NextLabel(rr.Header().Name, 0); rr.Header().Name[off:] != tt.encloser {
+				t.Errorf("Expected NSEC owner %s of %s to be directly below %s", rr.Header().Name, tt.qname, tt.encloser)
+			}
+		}
+		if !slices.Equal(next, tt.next) {
+			t.Errorf("Expected NSEC records of %s ending at %v but got %v", tt.qname, tt.next, next)
+		}
+	}
+
+	// A missing type is denied by an NSEC record at the name
+	m := querySigned(t, ts, "db.example.com.", dns.TypeAAAA, dns.RcodeSuccess)
+	checkSigned(t, ts, m.Ns)
+	nsecs := recordsOfType(m.Ns, dns.TypeNSEC)
+	if len(nsecs) != 1 || nsecs[0].Header().Name != "db.example.com." {
+		t.Fatalf("Expected an NSEC record at db.example.com. but got %v", nsecs)
+	}
+	if bitmap := nsecs[0].(*dns.NSEC).TypeBitMap; !slices.Equal(bitmap, []uint16{dns.TypeA, dns.TypeRRSIG, dns.TypeNSEC}) {
+		t.Errorf("Expected types A RRSIG NSEC but got %v", bitmap)
+	}
+}
+
+func TestServeDNSSECDenialNSEC3(t *testing.T) {
+	ts := newSignedTailscale(t, denialNSEC3)
+
+	tests := []struct {
+		name    string
+		qname   string
+		qtype   uint16
+		rcode   int
+		matches []string
+		covers  []string
+	}{
+		{
+			name:    "missing name",
+			qname:   "missing.example.com.",
+			qtype:   dns.TypeA,
+			rcode:   dns.RcodeNameError,
+			matches: []string{"example.com."},
+			covers:  []string{"missing.example.com.", "*.example.com."},
+		},
+		{
+			name:    "missing name below a node",
+			qname:   "a.b.web.example.com.",
+			qtype:   dns.TypeA,
+			rcode:   dns.RcodeNameError,
+			matches: []string{"web.example.com."},
+			covers:  []string{"b.web.example.com.", "*.web.example.com."},
+		},
+		{
+			name:    "missing type",
+			qname:   "db.example.com.",
+			qtype:   dns.TypeAAAA,
+			rcode:   dns.RcodeSuccess,
+			matches: []string{"db.example.com."},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			m := querySigned(t, ts, tt.qname, tt.qtype, tt.rcode)
+			checkSigned(t, ts, m.Ns)
+
+			nsec3s := recordsOfType(m.Ns, dns.TypeNSEC3)
+			if len(nsec3s) != len(tt.matches)+len(tt.covers) {
+				t.Fatalf("Expected %d NSEC3 records but got %v", len(tt.matches)+len(tt.covers), nsec3s)
+			}
+			for i, name := range tt.matches {
+				if !nsec3s[i].(*dns.NSEC3).Match(name) {
+					t.Errorf("Expected NSEC3 record %d to match %s", i, name)
+				}
+			}
+			for i, name := range tt.covers {
+				rr := nsec3s[len(tt.matches)+i].(*dns.NSEC3)
+				if !rr.Cover(name) || rr.Match(name) {
+					t.Errorf("Expected NSEC3 record %d to cover %s", len(tt.matches)+i, name)
+				}
+			}
+		})
+	}
+}
+
+func TestServeDNSSECReverseZone(t *testing.T) {
+	tests := []struct {
+		name    string
+		qname   string
+		qtype   uint16
+		rcode   int
+		answers int
+		denial  bool
+	}{
+		{name: "node address", qname: "2.0.64.100.in-addr.arpa.", qtype: dns.TypePTR, rcode: dns.RcodeSuccess, answers: 1},
+		{name: "missing address", qname: "9.0.64.100.in-addr.arpa.", qtype: dns.TypePTR, rcode: dns.RcodeNameError, denial: true},
+		{name: "empty non-terminal", qname: "0.64.100.in-addr.arpa.", qtype: dns.TypePTR, rcode: dns.RcodeSuccess, denial: true},
+		{name: "missing type", qname: "2.0.64.100.in-addr.arpa.", qtype: dns.TypeA, rcode: dns.RcodeSuccess, denial: true},
+		{name: "apex SOA", qname: "64.100.in-addr.arpa.", qtype: dns.TypeSOA, rcode: dns.RcodeSuccess, answers: 1},
+		{name: "apex NS", qname: "64.100.in-addr.arpa.", qtype: dns.TypeNS, rcode: dns.RcodeSuccess, answers: 1},
+	}
+
+	for _, method := range []string{denialNSEC, denialNSEC3} {
+		ts := newSignedTailscale(t, method)
+		for _, tt := range tests {
+			t.Run(method+" "+tt.name, func(t *testing.T) {
+				m := querySigned(t, ts, tt.qname, tt.qtype, tt.rcode)
+				if got := len(m.Answer) - len(recordsOfType(m.Answer, dns.TypeRRSIG)); got != tt.answers {
+					t.Fatalf("Expected %d answers but got %v", tt.answers, m.Answer)
+				}
+				checkSigned(t, ts, m.Answer)
+				checkSigned(t, ts, m.Ns)
+
+				if !tt.denial {
+					return
+				}
+				if soa := recordsOfType(m.Ns, dns.TypeSOA); len(soa) != 1 || soa[0].Header().Name != "64.100.in-addr.arpa." {
+					t.Errorf("Expected the SOA of 64.100.in-addr.arpa. but got %v", soa)
+				}
+				if len(recordsOfType(m.Ns, dns.TypeNSEC))+len(recordsOfType(m.Ns, dns.TypeNSEC3)) == 0 {
+					t.Errorf("Expected a denial of existence but got %v", m.Ns)
+				}
+			})
+		}
+	}
+
+	// Reverse zones without keys still pass missing addresses on
+	ts := newSignedTailscale(t, denialNSEC)
+	query(t, ts, "9.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.e.1.a.c.5.1.1.a.7.d.f.ip6.arpa.", dns.TypePTR, dns.RcodeRefused)
+}
+
+func TestIsTailnetReverseZone(t *testing.T) {
+	tests := []struct {
+		zone     string
+		expected bool
+	}{
+		{zone: "64.100.in-addr.arpa.", expected: true},
+		{zone: "0.64.100.in-addr.arpa.", expected: true},
+		{zone: "127.100.in-addr.arpa.", expected: true},
+		{zone: "0.e.1.a.c.5.1.1.a.7.d.f.ip6.arpa.", expected: true},
+		{zone: "100.in-addr.arpa.", expected: false},
+		{zone: "128.100.in-addr.arpa.", expected: false},
+		{zone: "168.192.in-addr.arpa.", expected: false},
+		{zone: "e.1.a.c.5.1.1.a.7.d.f.ip6.arpa.", expected: false},
+		{zone: "example.com.", expected: false},
+		{zone: "x.100.in-addr.arpa.", expected: false},
+	}
+
+	for _, tt := range tests {
+		if got := isTailnetReverseZone(tt.zone); got != tt.expected {
+			t.Errorf("Expected %s to be a tailnet reverse zone: %v but got %v", tt.zone, tt.expected, got)
+		}
+	}
+}
+
+func TestSuccessor(t *testing.T) {
+	full := strings.Repeat("a", 63)
+	tests := []struct {
+		name     string
+		expected string
+		ok       bool
+	}{
+		{name: "b.example.com.", expected: `b\000.example.com.`, ok: true},
+		{name: "*.example.com.", expected: `\042\000.example.com.`, ok: true},
+		{name: full + ".example.com.", expected: strings.Repeat("a", 62) + "b.example.com.", ok: true},
+		{name: strings.Repeat("a", 62) + `\255.example.com.`, ok: false},
+	}
+
+	for _, tt := range tests {
+		got, ok := successor(tt.name)
+		if ok != tt.ok || got != tt.expected {
+			t.Errorf("Expected successor of %s to be %q (%v) but got %q (%v)", tt.name, tt.expected, tt.ok, got, ok)
+		}
+	}
+}
+
+func TestPredecessor(t *testing.T) {
+	tests := []struct {
+		name     string
+		expected string
+		ok       bool
+	}{
+		{
+			name:     "b.example.com.",
+			expected: "a" + strings.Repeat(`\255`, 62) + ".example.com.",
+			ok:       true,
+		},
+		{
+			name:     "*.example.com.",
+			expected: `\041` + strings.Repeat(`\255`, 62) + ".example.com.",
+			ok:       true,
+		},
+		{
+			name:     "a[.example.com.",
+			expected: `a\064` + strings.Repeat(`\255`, 61) + ".example.com.",
+			ok:       true,
+		},
+		{
+			name: `a\000.example.com.`,
+			ok:   false,
+		},
+	}
+
+	for _, tt := range tests {
+		got, ok := predecessor(tt.name)
+		if ok != tt.ok || got != tt.expected {
+			t.Errorf("Expected predecessor of %s to be %q (%v) but got %q (%v)", tt.name, tt.expected, tt.ok, got, ok)
+		}
+	}
+}
@@ -0,0 +1,132 @@
+package plugin
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"tailscale.com/ipn/ipnstate"
+)
+
+// defaultHiddenTag is the tag that removes a node from DNS.
+const defaultHiddenTag = "tag:dns-hidden"
+
+// selector matches nodes by tag, OS or owner, written as tag:NAME, os:NAME or user:LOGIN.
+type selector struct {
+	kind  string // "tag", "os" or "user"
+	value string
+}
+
+// parseSelector parses a single node selector.
+func parseSelector(s string) (selector, error) {
+	kind, value, ok := strings.Cut(s, ":")
+	if !ok || value == "" {
+		return selector{}, fmt.Errorf("invalid selector '%s', expected tag:NAME, os:NAME or user:LOGIN", s)
+	}
+
+	kind = strings.ToLower(kind)
+	switch kind {
+	case "tag", "os", "user":
+	default:
+		return selector{}, fmt.Errorf("unknown selector type '%s' in '%s'", kind, s)
+	}
+	return selector{kind: kind, value: strings.ToLower(value)}, nil
+}
+
+// parseSelectors parses a list of node selectors.
+func parseSelectors(args []string) ([]selector, error) {
+	if len(args) == 0 {
+		return nil, fmt.Errorf("at least one selector is required")
+	}
+
+	selectors := make([]selector, 0, len(args))
+	for _, arg := range args {
+		sel, err := parseSelector(arg)
+		if err != nil {
+			return nil, err
+		}
+		selectors = append(selectors, sel)
+	}
+	return selectors, nil
+}
+
+// matches reports whether peer is selected by s. Owners are looked up in status.
+func (s selector) matches(peer *ipnstate.PeerStatus, status *ipnstate.Status) bool {
+	return s.matchesNode(identityOf(peer, status))
+}
+
+// matchesNode reports whether node is selected by s.
+func (s selector) matchesNode(node nodeIdentity) bool {
+	switch s.kind {
+	case "tag":
+		for _, tag := range node.Tags {
+			if strings.EqualFold(tag, "tag:"+s.value) {
+				return true
+			}
+		}
+	case "os":
+		return strings.EqualFold(node.OS, s.value)
+	case "user":
+		return node.User != "" && strings.EqualFold(node.User, s.value)
+	}
+	return false
+}
+
+// matchesAny reports whether peer is selected by any of selectors.
+func matchesAny(selectors []selector, peer *ipnstate.PeerStatus, status *ipnstate.Status) bool {
+	for _, s := range selectors {
+		if s.matches(peer, status) {
+			return true
+		}
+	}
+	return false
+}
+
+// hasTag reports whether peer carries tag.
+func hasTag(peer *ipnstate.PeerStatus, tag string) bool {
+	if peer.Tags == nil {
+		return false
+	}
+	for _, t := range peer.Tags.AsSlice() {
+		if strings.EqualFold(t, tag) {
+			return true
+		}
+	}
+	return false
+}
+
+// nodeFilter decides which nodes are published, the self node included.
+type nodeFilter struct {
+	onlineOnly     bool          // drop peers not connected to the control plane
+	maxLastSeen    time.Duration // drop offline peers last seen longer ago; 0 disables
+	excludeExpired bool          // drop peers whose node key has expired
+	include        []selector    // when set, only publish peers matching one of these
+	exclude        []selector    // never publish peers matching one of these
+	hiddenTag      string        // opt-out tag, always honored
+}
+
+// allows reports whether peer passes the filter at time now.
+func (f *nodeFilter) allows(peer *ipnstate.PeerStatus, status *ipnstate.Status, now time.Time) bool {
+	if f.hiddenTag != "" && hasTag(peer, f.hiddenTag) {
+		return false
+	}
+
+	if f.onlineOnly && !peer.Online {
+		return false
+	}
+
+	// LastSeen is only reported for offline peers
+	if f.maxLastSeen > 0 && !peer.Online && !peer.LastSeen.IsZero() && now.Sub(peer.LastSeen) > f.maxLastSeen {
+		return false
+	}
+
+	if f.excludeExpired && (peer.Expired || (peer.KeyExpiry != nil && peer.KeyExpiry.Before(now))) {
+		return false
+	}
+
+	if len(f.include) > 0 && !matchesAny(f.include, peer, status) {
+		return false
+	}
+
+	return !matchesAny(f.exclude, peer, status)
+}
@@ -0,0 +1,161 @@
+package plugin
+
+import (
+	"testing"
+	"time"
+
+	"tailscale.com/ipn/ipnstate"
+	"tailscale.com/tailcfg"
+)
+
+func TestNodeFilterAllows(t *testing.T) {
+	now := time.Date(2025, 6, 1, 12, 0, 0, 0, time.UTC)
+	expired := now.Add(-time.Hour)
+	valid := now.Add(time.Hour)
+
+	status := &ipnstate.Status{
+		User: map[tailcfg.UserID]tailcfg.UserProfile{
+			1: {ID: 1, LoginName: "alice@example.com"},
+			2: {ID: 2, LoginName: "bob@example.com"},
+		},
+	}
+
+	tests := []struct {
+		name   string
+		filter nodeFilter
+		peer   ipnstate.PeerStatus
+		want   bool
+	}{
+		{
+			name:   "no filter",
+			filter: nodeFilter{},
+			peer:   ipnstate.PeerStatus{},
+			want:   true,
+		},
+		{
+			name:   "hidden tag",
+			filter: nodeFilter{hiddenTag: defaultHiddenTag},
+			peer:   ipnstate.PeerStatus{Tags: tags("tag:web", "tag:dns-hidden")},
+			want:   false,
+		},
+		{
+			name:   "offline peer with online_only",
+			filter: nodeFilter{onlineOnly: true},
+			peer:   ipnstate.PeerStatus{Online: false},
+			want:   false,
+		},
+		{
+			name:   "online peer with online_only",
+			filter: nodeFilter{onlineOnly: true},
+			peer:   ipnstate.PeerStatus{Online: true},
+			want:   true,
+		},
+		{
+			name:   "peer seen recently",
+			filter: nodeFilter{maxLastSeen: 24 * time.Hour},
+			peer:   ipnstate.PeerStatus{LastSeen: now.Add(-time.Hour)},
+			want:   true,
+		},
+		{
+			name:   "peer not seen for too long",
+			filter: nodeFilter{maxLastSeen: 24 * time.Hour},
+			peer:   ipnstate.PeerStatus{LastSeen: now.Add(-48 * time.Hour)},
+			want:   false,
+		},
+		{
+			name:   "expired flag",
+			filter: nodeFilter{excludeExpired: true},
+			peer:   ipnstate.PeerStatus{Expired: true},
+			want:   false,
+		},
+		{
+			name:   "key expiry in the past",
+			filter: nodeFilter{excludeExpired: true},
+			peer:   ipnstate.PeerStatus{KeyExpiry: &expired},
+			want:   false,
+		},
+		{
+			name:   "key expiry in the future",
+			filter: nodeFilter{excludeExpired: true},
+			peer:   ipnstate.PeerStatus{KeyExpiry: &valid},
+			want:   true,
+		},
+		{
+			name:   "expired key without exclude_expired",
+			filter: nodeFilter{},
+			peer:   ipnstate.PeerStatus{KeyExpiry: &expired},
+			want:   true,
+		},
+		{
+			name:   "include by tag",
+			filter: nodeFilter{include: []selector{{kind: "tag", value: "web"}}},
+			peer:   ipnstate.PeerStatus{Tags: tags("tag:web")},
+			want:   true,
+		},
+		{
+			name:   "not included",
+			filter: nodeFilter{include: []selector{{kind: "tag", value: "web"}, {kind: "os", value: "linux"}}},
+			peer:   ipnstate.PeerStatus{OS: "windows"},
+			want:   false,
+		},
+		{
+			name:   "include by OS",
+			filter: nodeFilter{include: []selector{{kind: "tag", value: "web"}, {kind: "os", value: "linux"}}},
+			peer:   ipnstate.PeerStatus{OS: "linux"},
+			want:   true,
+		},
+		{
+			name:   "exclude by owner",
+			filter: nodeFilter{exclude: []selector{{kind: "user", value: "bob@example.com"}}},
+			peer:   ipnstate.PeerStatus{UserID: 2},
+			want:   false,
+		},
+		{
+			name:   "other owner",
+			filter: nodeFilter{exclude: []selector{{kind: "user", value: "bob@example.com"}}},
+			peer:   ipnstate.PeerStatus{UserID: 1},
+			want:   true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tt.filter.allows(&tt.peer, status, now); got != tt.want {
+				t.Errorf("Expected %t but got %t", tt.want, got)
+			}
+		})
+	}
+}
+
+func TestParseSelector(t *testing.T) {
+	tests := []struct {
+		input   string
+		want    selector
+		wantErr bool
+	}{
+		{input: "tag:web", want: selector{kind: "tag", value: "web"}},
+		{input: "os:Linux", want: selector{kind: "os", value: "linux"}},
+		{input: "user:alice@example.com", want: selector{kind: "user", value: "alice@example.com"}},
+		{input: "web", wantErr: true},
+		{input: "tag:", wantErr: true},
+		{input: "group:admins", wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.input, func(t *testing.T) {
+			got, err := parseSelector(tt.input)
+			if tt.wantErr {
+				if err == nil {
+					t.Fatal("Expected error but got none")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Unexpected error: %v", err)
+			}
+			if got != tt.want {
+				t.Errorf("Expected %v but got %v", tt.want, got)
+			}
+		})
+	}
+}
@@ -0,0 +1,152 @@
+package plugin
+
+import (
+	"bufio"
+	"fmt"
+	"net/netip"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"tailscale.com/ipn/ipnstate"
+)
+
+// defaultLANTagPrefix marks tags carrying a node's LAN address, such as tag:lan-192-168-1-10.
+const defaultLANTagPrefix = "tag:lan-"
+
+// lanSources configures where the alternate addresses that clients outside the
+// tailnet receive come from. Sources are tried in the order mapping file, tags,
+// routes; nodes without an alternate address keep their Tailscale addresses.
+type lanSources struct {
+	path      string                  // mapping file of lan_map; empty disables
+	hosts     map[string][]netip.Addr // host name or MagicDNS label -> addresses, from the mapping file
+	modTime   time.Time               // modification time of the mapping file when last read
+	size      int64                   // size of the mapping file when last read
+	tagPrefix string                  // prefix of tags carrying an address; empty disables
+	routes    bool                    // use endpoints inside the node's advertised subnet routes
+}
+
+// enabled reports whether split-horizon answers are configured.
+func (s *lanSources) enabled() bool {
+	return s.path != "" || s.tagPrefix != "" || s.routes
+}
+
+// reload reads the mapping file again when its modification time or size
+// changed since the last read. On failure the previous mapping is kept.
+func (s *lanSources) reload() error {
+	if s.path == "" {
+		return nil
+	}
+	info, err := os.Stat(filepath.Clean(s.path))
+	if err != nil {
+		return err
+	}
+	if s.hosts != nil && info.ModTime().Equal(s.modTime) && info.Size() == s.size {
+		return nil
+	}
+
+	hosts, err := parseLANMap(s.path)
+	if err != nil {
+		return err
+	}
+	s.hosts, s.modTime, s.size = hosts, info.ModTime(), info.Size()
+	return nil
+}
+
+// addresses returns the LAN addresses of peer from the first source that has any.
+func (s *lanSources) addresses(peer *ipnstate.PeerStatus) []netip.Addr {
+	if s.hosts != nil {
+		if addrs := s.hosts[sanitizeLabel(peer.HostName)]; len(addrs) > 0 {
+			return addrs
+		}
+		if addrs := s.hosts[magicDNSLabel(peer)]; len(addrs) > 0 {
+			return addrs
+		}
+	}
+
+	var addrs []netip.Addr
+	if s.tagPrefix != "" && peer.Tags != nil {
+		for _, tag := range peer.Tags.AsSlice() {
+			if !strings.HasPrefix(tag, s.tagPrefix) {
+				continue
+			}
+			if addr, ok := parseTagAddr(strings.TrimPrefix(tag, s.tagPrefix)); ok {
+				addrs = append(addrs, addr)
+			}
+		}
+		if len(addrs) > 0 {
+			return addrs
+		}
+	}
+
+	if s.routes && peer.AllowedIPs != nil {
+		for _, endpoint := range peer.Addrs {
+			ap, err := netip.ParseAddrPort(endpoint)
+			if err != nil {
+				continue
+			}
+			for _, route := range peer.AllowedIPs.AsSlice() {
+				// Skip the node's own Tailscale addresses and exit node routes
+				if route.Bits() == 0 || isTailnetIP(route.Addr()) {
+					continue
+				}
+				if route.Contains(ap.Addr().Unmap()) {
+					addrs = append(addrs, ap.Addr().Unmap())
+					break
+				}
+			}
+		}
+	}
+	return addrs
+}
+
+// parseTagAddr parses an address written in a tag, with hyphens in place of
+// the dots of an IPv4 address or the colons of an IPv6 address, such as
+// 192-168-1-10 or fd00--10.
+func parseTagAddr(value string) (netip.Addr, bool) {
+	if addr, err := netip.ParseAddr(strings.ReplaceAll(value, "-", ".")); err == nil && addr.Is4() {
+		return addr, true
+	}
+	if addr, err := netip.ParseAddr(strings.ReplaceAll(value, "-", ":")); err == nil && addr.Is6() {
+		return addr, true
+	}
+	return netip.Addr{}, false
+}
+
+// parseLANMap reads a mapping file of LAN addresses. Each line holds a host
+// name or MagicDNS machine name followed by one or more addresses; text after
+// a # is a comment.
+func parseLANMap(path string) (map[string][]netip.Addr, error) {
+	f, err := os.Open(filepath.Clean(path))
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	hosts := make(map[string][]netip.Addr)
+	scanner := bufio.NewScanner(f)
+	for line := 1; scanner.Scan(); line++ {
+		text, _, _ := strings.Cut(scanner.Text(), "#")
+		fields := strings.Fields(text)
+		if len(fields) == 0 {
+			continue
+		}
+		if len(fields) < 2 {
+			return nil, fmt.Errorf("%s:%d: expected a host followed by addresses", path, line)
+		}
+
+		host := sanitizeLabel(fields[0])
+		for _, field := range fields[1:] {
+			addr, err := netip.ParseAddr(field)
+			if err != nil {
+				return nil, fmt.Errorf("%s:%d: invalid address '%s'", path, line, field)
+			}
+			hosts[host] = append(hosts[host], addr)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return hosts, nil
+}
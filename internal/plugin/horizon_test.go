@@ -0,0 +1,225 @@
+package plugin
+
+import (
+	"net/netip"
+	"os"
+	"path/filepath"
+	"slices"
+	"sort"
+	"testing"
+
+	"github.com/coredns/coredns/plugin/test"
+	"github.com/miekg/dns"
+	"tailscale.com/ipn/ipnstate"
+	"tailscale.com/types/views"
+)
+
+func TestParseTagAddr(t *testing.T) {
+	tests := []struct {
+		value    string
+		expected string
+		ok       bool
+	}{
+		{value: "192-168-1-10", expected: "192.168.1.10", ok: true},
+		{value: "fd00--10", expected: "fd00::10", ok: true},
+		{value: "2001-db8-0-0-0-0-0-1", expected: "2001:db8::1", ok: true},
+		{value: "192-168-1", ok: false},
+		{value: "office", ok: false},
+	}
+
+	for _, tt := range tests {
+		addr, ok := parseTagAddr(tt.value)
+		if ok != tt.ok || (ok && addr.String() != tt.expected) {
+			t.Errorf("Expected %s to parse as %q (%v) but got %s (%v)", tt.value, tt.expected, tt.ok, addr, ok)
+		}
+	}
+}
+
+func TestParseLANMap(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "lan.hosts")
+	content := "# office hosts\nweb 192.168.1.20 fd00::20\n\nDB 192.168.1.30 # primary\n"
+	if err := os.WriteFile(path, []byte(content), 0o600); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	hosts, err := parseLANMap(path)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	expected := map[string][]netip.Addr{
+		"web": {netip.MustParseAddr("192.168.1.20"), netip.MustParseAddr("fd00::20")},
+		"db":  {netip.MustParseAddr("192.168.1.30")},
+	}
+	if len(hosts) != len(expected) {
+		t.Fatalf("Expected %v but got %v", expected, hosts)
+	}
+	for host, addrs := range expected {
+		if !slices.Equal(hosts[host], addrs) {
+			t.Errorf("Expected %s to map to %v but got %v", host, addrs, hosts[host])
+		}
+	}
+
+	for _, content := range []string{"web\n", "web 192.168.1\n"} {
+		bad := filepath.Join(dir, "bad.hosts")
+		if err := os.WriteFile(bad, []byte(content), 0o600); err != nil {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+		if _, err := parseLANMap(bad); err == nil {
+			t.Errorf("Expected error for %q", content)
+		}
+	}
+}
+
+func TestLANMapReload(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "lan.hosts")
+	write := func(content string) {
+		t.Helper()
+		if err := os.WriteFile(path, []byte(content), 0o600); err != nil {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+	}
+
+	write("web 192.168.1.20\n")
+	sources := lanSources{path: path}
+	if err := sources.reload(); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	write("web 192.168.1.21\ndb 192.168.1.30\n")
+	if err := sources.reload(); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if len(sources.hosts) != 2 || sources.hosts["web"][0] != netip.MustParseAddr("192.168.1.21") {
+		t.Errorf("Expected the changed mapping file to be read but got %v", sources.hosts)
+	}
+
+	// Broken or missing files keep the previous mapping
+	previous := sources.hosts
+	write("web 192.168.1\n")
+	if err := sources.reload(); err == nil {
+		t.Errorf("Expected error for an invalid mapping file")
+	}
+	if err := os.Remove(path); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if err := sources.reload(); err == nil {
+		t.Errorf("Expected error for a missing mapping file")
+	}
+	if len(sources.hosts) != len(previous) || sources.hosts["db"][0] != previous["db"][0] {
+		t.Errorf("Expected the previous mapping %v to be kept but got %v", previous, sources.hosts)
+	}
+}
+
+func TestLANAddresses(t *testing.T) {
+	routes := views.SliceOf([]netip.Prefix{
+		netip.MustParsePrefix("100.64.0.2/32"),
+		netip.MustParsePrefix("192.168.1.0/24"),
+		netip.MustParsePrefix("0.0.0.0/0"),
+	})
+	peer := &ipnstate.PeerStatus{
+		HostName:   "web",
+		Tags:       tags("tag:lan-192-168-1-21", "tag:server"),
+		Addrs:      []string{"203.0.113.7:41641", "192.168.1.22:41641"},
+		AllowedIPs: &routes,
+	}
+	hosts := map[string][]netip.Addr{"web": {netip.MustParseAddr("192.168.1.20")}}
+
+	tests := []struct {
+		name     string
+		sources  lanSources
+		expected []string
+	}{
+		{name: "mapping file first", sources: lanSources{hosts: hosts, tagPrefix: defaultLANTagPrefix, routes: true}, expected: []string{"192.168.1.20"}},
+		{name: "tags before routes", sources: lanSources{tagPrefix: defaultLANTagPrefix, routes: true}, expected: []string{"192.168.1.21"}},
+		{name: "endpoints inside subnet routes", sources: lanSources{routes: true}, expected: []string{"192.168.1.22"}},
+		{name: "host missing from the mapping file", sources: lanSources{hosts: map[string][]netip.Addr{}}, expected: nil},
+	}
+
+	for _, tt := range tests {
+		var got []string
+		for _, addr := range tt.sources.addresses(peer) {
+			got = append(got, addr.String())
+		}
+		if !slices.Equal(got, tt.expected) {
+			t.Errorf("%s: expected %v but got %v", tt.name, tt.expected, got)
+		}
+	}
+}
+
+func TestServeDNSLAN(t *testing.T) {
+	status := testStatus()
+	for _, peer := range status.Peer {
+		if peer.HostName == "web" {
+			peer.Tags = tags("tag:cname-app", "tag:srv-http-tcp-8080", "tag:service-frontend", "tag:lan-192-168-1-20")
+		}
+	}
+	ts := newTestTailscale([]string{"example.com"}, status, func(ts *Tailscale) {
+		ts.lan.tagPrefix = defaultLANTagPrefix
+	})
+
+	tests := []struct {
+		name    string
+		source  string
+		qname   string
+		qtype   uint16
+		answers []string
+	}{
+		{
+			name:    "LAN client gets the LAN address",
+			source:  "192.168.1.50",
+			qname:   "web.example.com.",
+			qtype:   dns.TypeA,
+			answers: []string{"web.example.com.\t60\tIN\tA\t192.168.1.20"},
+		},
+		{
+			name:   "LAN client gets no tailnet IPv6 address",
+			source: "192.168.1.50",
+			qname:  "web.example.com.",
+			qtype:  dns.TypeAAAA,
+		},
+		{
+			name:    "LAN client follows aliases to the LAN address",
+			source:  "192.168.1.50",
+			qname:   "app.example.com.",
+			qtype:   dns.TypeA,
+			answers: []string{"app.example.com.\t60\tIN\tCNAME\tweb.example.com.", "web.example.com.\t60\tIN\tA\t192.168.1.20"},
+		},
+		{
+			name:    "LAN client gets LAN and tailnet addresses of a service group",
+			source:  "192.168.1.50",
+			qname:   "frontend.example.com.",
+			qtype:   dns.TypeA,
+			answers: []string{"frontend.example.com.\t60\tIN\tA\t100.100.0.4", "frontend.example.com.\t60\tIN\tA\t100.64.0.4", "frontend.example.com.\t60\tIN\tA\t192.168.1.20"},
+		},
+		{
+			name:    "node without a LAN address keeps its tailnet address",
+			source:  "192.168.1.50",
+			qname:   "db.example.com.",
+			qtype:   dns.TypeA,
+			answers: []string{"db.example.com.\t60\tIN\tA\t100.64.0.3"},
+		},
+		{
+			name:    "tailnet client gets the tailnet address",
+			source:  "100.64.0.9",
+			qname:   "web.example.com.",
+			qtype:   dns.TypeA,
+			answers: []string{"web.example.com.\t60\tIN\tA\t100.64.0.2"},
+		},
+		{
+			name:    "tailnet client gets the tailnet IPv6 address",
+			source:  "fd7a:115c:a1e0::9",
+			qname:   "web.example.com.",
+			qtype:   dns.TypeAAAA,
+			answers: []string{"web.example.com.\t60\tIN\tAAAA\tfd7a:115c:a1e0::2"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			m := queryFrom(t, ts, tt.source, tt.qname, tt.qtype, dns.RcodeSuccess)
+			sort.Sort(test.RRSet(m.Answer))
+			checkSection(t, "answer", m.Answer, tt.answers)
+		})
+	}
+}
@@ -0,0 +1,55 @@
+package plugin
+
+import (
+	"context"
+	"net/netip"
+	"strings"
+	"sync"
+
+	"github.com/coredns/coredns/plugin/metadata"
+	"github.com/coredns/coredns/request"
+	"tailscale.com/client/tailscale/apitype"
+)
+
+// Metadata implements metadata.Provider. It publishes the tailnet identity of
+// the source of a query as tailscale/node, tailscale/user, tailscale/tags and
+// tailscale/os. The identity is only looked up when one of them is used, and
+// the values are empty for sources that are not tailnet nodes.
+func (t *Tailscale) Metadata(ctx context.Context, state request.Request) context.Context {
+	var once sync.Once
+	var who *apitype.WhoIsResponse
+	identify := func() *apitype.WhoIsResponse {
+		once.Do(func() {
+			if addr, err := netip.ParseAddr(state.IP()); err == nil {
+				who = t.whois.identify(ctx, addr)
+			}
+		})
+		return who
+	}
+
+	metadata.SetValueFunc(ctx, "tailscale/node", func() string {
+		if who := identify(); who != nil && who.Node != nil {
+			return strings.TrimSuffix(who.Node.Name, ".")
+		}
+		return ""
+	})
+	metadata.SetValueFunc(ctx, "tailscale/user", func() string {
+		if who := identify(); who != nil && who.UserProfile != nil {
+			return who.UserProfile.LoginName
+		}
+		return ""
+	})
+	metadata.SetValueFunc(ctx, "tailscale/tags", func() string {
+		if who := identify(); who != nil && who.Node != nil {
+			return strings.Join(who.Node.Tags, ",")
+		}
+		return ""
+	})
+	metadata.SetValueFunc(ctx, "tailscale/os", func() string {
+		if who := identify(); who != nil && who.Node != nil && who.Node.Hostinfo.Valid() {
+			return who.Node.Hostinfo.OS()
+		}
+		return ""
+	})
+	return ctx
+}
@@ -0,0 +1,84 @@
+package plugin
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/coredns/coredns/plugin/metadata"
+	"github.com/coredns/coredns/plugin/test"
+	"github.com/coredns/coredns/request"
+	"github.com/miekg/dns"
+	"tailscale.com/client/tailscale/apitype"
+	"tailscale.com/tailcfg"
+)
+
+func TestMetadata(t *testing.T) {
+	lookups := 0
+	ts := newTailscale([]string{"example.com"})
+	ts.whois = newWhoisCache(func(ctx context.Context, addr string) (*apitype.WhoIsResponse, error) {
+		lookups++
+		if addr != "100.64.0.9" {
+			return nil, errors.New("no match for IP")
+		}
+		return &apitype.WhoIsResponse{
+			Node: &tailcfg.Node{
+				Name:     "build-1.tailnet.ts.net.",
+				Tags:     []string{"tag:ci", "tag:linux"},
+				Hostinfo: (&tailcfg.Hostinfo{OS: "linux"}).View(),
+			},
+			UserProfile: &tailcfg.UserProfile{LoginName: "tagged-devices"},
+		}, nil
+	})
+
+	tests := []struct {
+		name     string
+		source   string
+		expected map[string]string
+	}{
+		{
+			name:   "tailnet node",
+			source: "100.64.0.9",
+			expected: map[string]string{
+				"tailscale/node": "build-1.tailnet.ts.net",
+				"tailscale/user": "tagged-devices",
+				"tailscale/tags": "tag:ci,tag:linux",
+				"tailscale/os":   "linux",
+			},
+		},
+		{
+			name:   "source outside the tailnet",
+			source: "192.0.2.1",
+			expected: map[string]string{
+				"tailscale/node": "",
+				"tailscale/user": "",
+				"tailscale/tags": "",
+				"tailscale/os":   "",
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := new(dns.Msg)
+			req.SetQuestion("web.example.com.", dns.TypeA)
+			state := request.Request{W: &test.ResponseWriter{RemoteIP: tt.source}, Req: req}
+
+			ctx := ts.Metadata(metadata.ContextWithMetadata(context.Background()), state)
+			for label, expected := range tt.expected {
+				f := metadata.ValueFunc(ctx, label)
+				if f == nil {
+					t.Fatalf("Expected metadata %s to be set", label)
+				}
+				if got := f(); got != expected {
+					t.Errorf("Expected %s to be %q but got %q", label, expected, got)
+				}
+			}
+		})
+	}
+
+	// The identity is looked up once and cached
+	if lookups != 1 {
+		t.Errorf("Expected 1 lookup but got %d", lookups)
+	}
+}
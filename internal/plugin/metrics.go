@@ -0,0 +1,112 @@
+package plugin
+
+import (
+	"sync/atomic"
+	"time"
+
+	"github.com/coredns/coredns/plugin"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+// Results of the queries counter.
+const (
+	resultAnswered    = "answered"
+	resultFallthrough = "fallthrough"
+)
+
+// lastRefreshSuccess holds the Unix time in nanoseconds of the last successful
+// refresh, or of the plugin's load before the first one.
+var lastRefreshSuccess atomic.Int64
+
+func init() {
+	lastRefreshSuccess.Store(time.Now().UnixNano())
+}
+
+// Variables declared for monitoring.
+var (
+	nameCollisions = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: plugin.Namespace,
+		Subsystem: "tailscale",
+		Name:      "name_collisions",
+		Help:      "Gauge of node names and tag aliases in the current record table that collided with the name or alias of another node.",
+	}, []string{"zone"})
+
+	recordsPublished = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: plugin.Namespace,
+		Subsystem: "tailscale",
+		Name:      "records",
+		Help:      "Gauge of names published in a zone, counting nodes, service groups, aliases and services.",
+	}, []string{"zone"})
+
+	staleRecords = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: plugin.Namespace,
+		Subsystem: "tailscale",
+		Name:      "stale",
+		Help:      "Gauge set to 1 while a zone is served from a snapshot because tailscaled has not responded since startup.",
+	}, []string{"zone"})
+
+	refreshDuration = promauto.NewHistogram(prometheus.HistogramOpts{
+		Namespace: plugin.Namespace,
+		Subsystem: "tailscale",
+		Name:      "refresh_duration_seconds",
+		Buckets:   plugin.TimeBuckets,
+		Help:      "Histogram of the time taken to read the Tailscale status and rebuild the records.",
+	})
+
+	refreshErrors = promauto.NewCounter(prometheus.CounterOpts{
+		Namespace: plugin.Namespace,
+		Subsystem: "tailscale",
+		Name:      "refresh_errors_total",
+		Help:      "Counter of failed attempts to read the Tailscale status.",
+	})
+
+	_ = promauto.NewGaugeFunc(prometheus.GaugeOpts{
+		Namespace: plugin.Namespace,
+		Subsystem: "tailscale",
+		Name:      "seconds_since_last_refresh",
+		Help:      "Gauge of the seconds since the Tailscale status was last read successfully.",
+	}, func() float64 {
+		return time.Since(time.Unix(0, lastRefreshSuccess.Load())).Seconds()
+	})
+
+	queryCount = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: plugin.Namespace,
+		Subsystem: "tailscale",
+		Name:      "queries_total",
+		Help:      "Counter of queries for the tailscale zones, answered by the plugin or passed to the next plugin.",
+	}, []string{"server", "type", "result"})
+
+	splitDNSVerifications = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: plugin.Namespace,
+		Subsystem: "tailscale",
+		Name:      "split_dns_verifications_total",
+		Help:      "Counter of split DNS verifications by result: ok, updated, unchanged or error.",
+	}, []string{"result"})
+)
+
+// recordCounts returns the number of names of table in each of zones. Names
+// are counted in the most specific zone containing them.
+func recordCounts(table *recordTable, zones []string) map[string]int {
+	counts := make(map[string]int, len(zones))
+	count := func(name string) {
+		if zone := plugin.Zones(zones).Matches(name); zone != "" {
+			counts[zone]++
+		}
+	}
+
+	for name := range table.Records {
+		count(name)
+	}
+	for name := range table.Groups {
+		count(name)
+	}
+	for name := range table.Aliases {
+		count(name)
+	}
+	for name := range table.Services {
+		count(name)
+	}
+	return counts
+}
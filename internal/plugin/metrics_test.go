@@ -0,0 +1,41 @@
+package plugin
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/miekg/dns"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestRecordCounts(t *testing.T) {
+	ts := newTestTailscale([]string{"example.com", "sub.example.com"}, testStatus(), nil)
+
+	// Names of sub.example.com are not counted again in example.com. Each zone
+	// has four nodes, the frontend group, the app alias and two services.
+	expected := map[string]int{"example.com.": 8, "sub.example.com.": 8}
+	if counts := recordCounts(ts.table, ts.zones); !reflect.DeepEqual(counts, expected) {
+		t.Errorf("Expected counts %v but got %v", expected, counts)
+	}
+}
+
+func TestQueryCount(t *testing.T) {
+	ts := newTestTailscale([]string{"example.com"}, testStatus(), func(ts *Tailscale) {
+		ts.fall.SetZonesFromArgs(nil)
+	})
+
+	answered := queryCount.WithLabelValues("", "A", resultAnswered)
+	passed := queryCount.WithLabelValues("", "A", resultFallthrough)
+	beforeAnswered, beforePassed := testutil.ToFloat64(answered), testutil.ToFloat64(passed)
+
+	query(t, ts, "web.example.com.", dns.TypeA, dns.RcodeSuccess)
+	query(t, ts, "missing.example.com.", dns.TypeA, dns.RcodeRefused)
+	query(t, ts, "example.org.", dns.TypeA, dns.RcodeRefused)
+
+	if got := testutil.ToFloat64(answered) - beforeAnswered; got != 1 {
+		t.Errorf("Expected 1 answered query but got %v", got)
+	}
+	if got := testutil.ToFloat64(passed) - beforePassed; got != 1 {
+		t.Errorf("Expected 1 query passed to the next plugin but got %v", got)
+	}
+}
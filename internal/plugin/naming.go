@@ -0,0 +1,346 @@
+package plugin
+
+import (
+	"fmt"
+	"slices"
+	"strings"
+	"text/template"
+	tmplparse "text/template/parse"
+	"unicode"
+
+	"github.com/miekg/dns"
+	"golang.org/x/net/idna"
+	"tailscale.com/ipn/ipnstate"
+)
+
+// defaultSubdomainTagPrefix marks tags whose value becomes {{.Tag}} in name templates.
+const defaultSubdomainTagPrefix = "tag:subdomain-"
+
+// Name sources accepted by the name_source option.
+const (
+	nameSourceHostName = "hostname" // host name reported by the device
+	nameSourceDNSName  = "dnsname"  // first label of the MagicDNS name
+	nameSourceBoth     = "both"
+)
+
+// defaultNameTemplates publish a node as host.domain and as host.sub.domain for
+// every subdomain tag, with hyphens in the tag turned into dots.
+var defaultNameTemplates = []*nameTemplate{
+	mustParseNameTemplate("{{.Host}}.{{.Domain}}"),
+	mustParseNameTemplate("{{.Host}}.{{dots .Tag}}.{{.Domain}}"),
+}
+
+// ownerNameTemplate is added to every domain by the owner_names option.
+var ownerNameTemplate = mustParseNameTemplate("{{.Host}}.{{.User}}.{{.Domain}}")
+
+// nameFuncs are the functions available in name templates.
+var nameFuncs = template.FuncMap{
+	"dots":  func(s string) string { return strings.ReplaceAll(s, "-", ".") },
+	"lower": strings.ToLower,
+}
+
+// nameData is the data a name template is executed with.
+type nameData struct {
+	Host   string // host name or MagicDNS label, depending on the name source
+	User   string // owner's login name as a single label; empty for tagged devices
+	OS     string // operating system reported by the device
+	Tag    string // value of a subdomain tag without its prefix
+	Domain string // configured domain, without trailing dot
+}
+
+// nameTemplate renders one name for a node.
+type nameTemplate struct {
+	text    string
+	tmpl    *template.Template
+	usesTag bool // rendered once per subdomain tag instead of once per node
+}
+
+// parseNameTemplate parses a name template and checks that it produces a
+// name under the domain.
+func parseNameTemplate(text string) (*nameTemplate, error) {
+	tmpl, err := template.New("name").Funcs(nameFuncs).Option("missingkey=error").Parse(text)
+	if err != nil {
+		return nil, fmt.Errorf("invalid name template '%s': %w", text, err)
+	}
+
+	nt := &nameTemplate{text: text, tmpl: tmpl, usesTag: usesField(tmpl.Root, "Tag")}
+
+	sample := nameData{Host: "host", User: "user", OS: "linux", Tag: "tag", Domain: "example.com"}
+	name, err := nt.execute(sample)
+	if err != nil {
+		return nil, fmt.Errorf("invalid name template '%s': %w", text, err)
+	}
+	if name == "" || !dns.IsSubDomain(sample.Domain+".", name) || name == sample.Domain+"." {
+		return nil, fmt.Errorf("name template '%s' must produce a name below {{.Domain}}", text)
+	}
+	return nt, nil
+}
+
+// usesField reports whether the parsed template node refers to the named field
+// of the data, as .Field or $.Field.
+func usesField(node tmplparse.Node, field string) bool {
+	switch n := node.(type) {
+	case *tmplparse.ListNode:
+		if n == nil {
+			return false
+		}
+		for _, child := range n.Nodes {
+			if usesField(child, field) {
+				return true
+			}
+		}
+	case *tmplparse.ActionNode:
+		return usesField(n.Pipe, field)
+	case *tmplparse.PipeNode:
+		if n == nil {
+			return false
+		}
+		for _, cmd := range n.Cmds {
+			if usesField(cmd, field) {
+				return true
+			}
+		}
+	case *tmplparse.CommandNode:
+		for _, arg := range n.Args {
+			if usesField(arg, field) {
+				return true
+			}
+		}
+	case *tmplparse.FieldNode:
+		return n.Ident[0] == field
+	case *tmplparse.VariableNode:
+		return len(n.Ident) > 1 && n.Ident[0] == "$" && n.Ident[1] == field
+	case *tmplparse.ChainNode:
+		return usesField(n.Node, field)
+	case *tmplparse.IfNode:
+		return usesField(n.Pipe, field) || usesField(n.List, field) || usesField(n.ElseList, field)
+	case *tmplparse.RangeNode:
+		return usesField(n.Pipe, field) || usesField(n.List, field) || usesField(n.ElseList, field)
+	case *tmplparse.WithNode:
+		return usesField(n.Pipe, field) || usesField(n.List, field) || usesField(n.ElseList, field)
+	case *tmplparse.TemplateNode:
+		return usesField(n.Pipe, field)
+	}
+	return false
+}
+
+// mustParseNameTemplate is like parseNameTemplate but panics on error.
+func mustParseNameTemplate(text string) *nameTemplate {
+	nt, err := parseNameTemplate(text)
+	if err != nil {
+		panic(err)
+	}
+	return nt
+}
+
+// execute renders the template as a fully qualified name. It returns an empty
+// name when the result is not a valid domain name, for example because a field
+// used by the template is empty for this node.
+func (nt *nameTemplate) execute(data nameData) (string, error) {
+	var buf strings.Builder
+	if err := nt.tmpl.Execute(&buf, data); err != nil {
+		return "", err
+	}
+
+	name := dns.Fqdn(strings.ToLower(strings.TrimSpace(buf.String())))
+	if _, ok := dns.IsDomainName(name); !ok || strings.Contains(name, "..") || strings.HasPrefix(name, ".") {
+		return "", nil
+	}
+	return name, nil
+}
+
+// nameClaims records which node owns each name while a record table is built,
+// so that a name produced for several nodes is published for one of them only.
+type nameClaims struct {
+	owners     map[string]*ipnstate.PeerStatus // FQDN -> node publishing it
+	primary    map[claimKey]string             // primary name of a node in a domain
+	collisions map[string]int                  // domain -> names that were already taken
+}
+
+// claimKey identifies a node within a domain.
+type claimKey struct {
+	node   *ipnstate.PeerStatus
+	domain string
+}
+
+// newNameClaims returns an empty set of claims.
+func newNameClaims() *nameClaims {
+	return &nameClaims{
+		owners:     make(map[string]*ipnstate.PeerStatus),
+		primary:    make(map[claimKey]string),
+		collisions: make(map[string]int),
+	}
+}
+
+// nodeNames returns the names of peer under domain, rendered from the domain's
+// name templates. The first name is the node's primary name, used as the target
+// of PTR, CNAME, SRV and NS records.
+//
+// Templates are rendered once per host label of the node, see hostLabels.
+// When claims is not nil, names already claimed by another node are rendered
+// again with the node's MagicDNS label as {{.Host}}, and dropped if that name is
+// taken too. Nodes must therefore be processed in a deterministic order.
+func (t *Tailscale) nodeNames(peer *ipnstate.PeerStatus, status *ipnstate.Status, domain string, claims *nameClaims) []string {
+	data := nameData{
+		User:   ownerLabel(peer, status),
+		OS:     sanitizeLabel(peer.OS),
+		Domain: domain,
+	}
+	fallback := magicDNSLabel(peer)
+
+	templates := t.nameTemplates[domain]
+	if len(templates) == 0 {
+		templates = defaultNameTemplates
+	}
+	if t.ownerNames {
+		templates = append(slices.Clip(templates), ownerNameTemplate)
+	}
+
+	var names []string
+	add := func(nt *nameTemplate, data nameData) {
+		name := t.renderName(nt, data, peer)
+		if name == "" {
+			return
+		}
+
+		if claims != nil {
+			if owner := claims.owners[name]; owner != nil && owner != peer {
+				claims.collisions[domain]++
+
+				alt := ""
+				if fallback != "" && fallback != data.Host {
+					altData := data
+					altData.Host = fallback
+					alt = t.renderName(nt, altData, peer)
+				}
+				if other := claims.owners[alt]; alt == "" || (other != nil && other != peer) {
+					t.warnings.warningf("name collision: %s of %s is already used by %s, not publishing it", name, describeNode(peer), describeNode(owner))
+					return
+				}
+				t.warnings.warningf("name collision: %s of %s is already used by %s, publishing %s instead", name, describeNode(peer), describeNode(owner), alt)
+				name = alt
+			}
+			claims.owners[name] = peer
+		}
+
+		if !slices.Contains(names, name) {
+			names = append(names, name)
+		}
+	}
+
+	for _, host := range t.hostLabels(peer) {
+		data.Host = host
+		for _, nt := range templates {
+			if !nt.usesTag {
+				add(nt, data)
+				continue
+			}
+			if peer.Tags == nil {
+				continue
+			}
+			for _, tag := range peer.Tags.AsSlice() {
+				if strings.HasPrefix(tag, t.subdomainTagPrefix) {
+					tagData := data
+					tagData.Tag = sanitizeLabel(strings.TrimPrefix(tag, t.subdomainTagPrefix))
+					add(nt, tagData)
+				}
+			}
+		}
+	}
+
+	if claims != nil && len(names) > 0 {
+		claims.primary[claimKey{node: peer, domain: domain}] = names[0]
+	}
+	return names
+}
+
+// hostLabels returns the values of {{.Host}} for peer according to the name
+// source. Nodes without a usable host name or MagicDNS name fall back to the
+// other one.
+func (t *Tailscale) hostLabels(peer *ipnstate.PeerStatus) []string {
+	host := sanitizeLabel(peer.HostName)
+	machine := magicDNSLabel(peer)
+	switch {
+	case machine == "":
+		return []string{host}
+	case host == "":
+		return []string{machine}
+	case t.nameSource == nameSourceHostName:
+		return []string{host}
+	case t.nameSource == nameSourceDNSName || host == machine:
+		return []string{machine}
+	}
+	return []string{host, machine}
+}
+
+// renderName executes a name template for peer, logging failures.
+func (t *Tailscale) renderName(nt *nameTemplate, data nameData, peer *ipnstate.PeerStatus) string {
+	name, err := nt.execute(data)
+	if err != nil {
+		t.warnings.warningf("failed to render name template '%s' for %s: %v", nt.text, describeNode(peer), err)
+		return ""
+	}
+	return name
+}
+
+// sanitizeLabel turns a device-provided string into a DNS label. Characters that
+// are not letters, digits or hyphens become hyphens, Unicode is converted to
+// punycode and the result is limited to 63 bytes. It returns an empty string
+// when nothing usable is left.
+func sanitizeLabel(s string) string {
+	label := strings.Map(func(r rune) rune {
+		if r == '-' || unicode.IsLetter(r) || unicode.IsDigit(r) {
+			return unicode.ToLower(r)
+		}
+		return '-'
+	}, s)
+
+	for strings.Contains(label, "--") {
+		label = strings.ReplaceAll(label, "--", "-")
+	}
+	label = strings.Trim(label, "-")
+
+	ascii, err := idna.Lookup.ToASCII(label)
+	if err != nil {
+		if ascii, err = idna.Punycode.ToASCII(label); err != nil {
+			return ""
+		}
+	}
+
+	if len(ascii) > 63 {
+		if strings.HasPrefix(ascii, "xn--") {
+			return ""
+		}
+		ascii = strings.TrimRight(ascii[:63], "-")
+	}
+	return ascii
+}
+
+// magicDNSLabel returns the first label of the node's MagicDNS name, which is
+// unique within the tailnet.
+func magicDNSLabel(peer *ipnstate.PeerStatus) string {
+	label, _, _ := strings.Cut(peer.DNSName, ".")
+	return sanitizeLabel(label)
+}
+
+// describeNode names a node in log messages.
+func describeNode(peer *ipnstate.PeerStatus) string {
+	if peer.DNSName != "" {
+		return peer.HostName + " (" + strings.TrimSuffix(peer.DNSName, ".") + ")"
+	}
+	return peer.HostName
+}
+
+// ownerLabel returns the local part of the login name of the peer's owner as a
+// single label, with dots replaced by hyphens. Tagged devices have no owner.
+func ownerLabel(peer *ipnstate.PeerStatus, status *ipnstate.Status) string {
+	if peer.IsTagged() {
+		return ""
+	}
+	user, ok := status.User[peer.UserID]
+	if !ok {
+		return ""
+	}
+	local, _, _ := strings.Cut(user.LoginName, "@")
+	return sanitizeLabel(local)
+}
@@ -0,0 +1,281 @@
+package plugin
+
+import (
+	"net/netip"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"tailscale.com/ipn/ipnstate"
+	"tailscale.com/tailcfg"
+	"tailscale.com/types/key"
+)
+
+func TestParseNameTemplate(t *testing.T) {
+	tests := []struct {
+		text    string
+		wantErr bool
+		usesTag bool
+	}{
+		{text: "{{.Host}}.{{.Domain}}"},
+		{text: "{{.Host}}-{{.OS}}.{{.Domain}}"},
+		{text: "{{.Host}}.{{dots .Tag}}.{{.Domain}}", usesTag: true},
+		{text: "{{.Host}}.{{.Tag | lower}}.{{.Domain}}", usesTag: true},
+		{text: "{{.Host}}{{if $.Tag}}-tagged{{end}}.{{.Domain}}", usesTag: true},
+		{text: "{{.Host}}.Tags.{{.Domain}}"},
+		{text: "{{.Host}}.{{.Domain}", wantErr: true},
+		{text: "{{.Hostname}}.{{.Domain}}", wantErr: true},
+		{text: "{{.Host}}.example.org", wantErr: true},
+		{text: "{{.Domain}}", wantErr: true},
+	}
+
+	for _, tt := range tests {
+		nt, err := parseNameTemplate(tt.text)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("parseNameTemplate(%q): expected error %v but got %v", tt.text, tt.wantErr, err)
+			continue
+		}
+		if err == nil && nt.usesTag != tt.usesTag {
+			t.Errorf("parseNameTemplate(%q): expected usesTag %v but got %v", tt.text, tt.usesTag, nt.usesTag)
+		}
+	}
+}
+
+func TestNodeNames(t *testing.T) {
+	status := &ipnstate.Status{
+		User: map[tailcfg.UserID]tailcfg.UserProfile{
+			1: {LoginName: "Alice@example.com"},
+			2: {LoginName: "bob.smith@example.com"},
+		},
+	}
+	laptop := &ipnstate.PeerStatus{HostName: "Laptop", OS: "linux", UserID: 1}
+	renamed := &ipnstate.PeerStatus{HostName: "laptop", DNSName: "build-01.tailnet.ts.net.", Tags: tags("tag:subdomain-ci")}
+	server := &ipnstate.PeerStatus{HostName: "server", OS: "linux", UserID: 1, Tags: tags("tag:subdomain-web-eu", "tag:subdomain-api", "tag:prod")}
+
+	tests := []struct {
+		name      string
+		templates []string
+		prefix    string
+		owner     bool
+		source    string
+		peer      *ipnstate.PeerStatus
+		expected  []string
+	}{
+		{
+			name:     "default",
+			peer:     server,
+			expected: []string{"server.example.com.", "server.web.eu.example.com.", "server.api.example.com."},
+		},
+		{
+			name:      "user and os",
+			templates: []string{"{{.Host}}.{{.User}}.{{.Domain}}", "{{.Host}}-{{.OS}}.{{.Domain}}"},
+			peer:      laptop,
+			expected:  []string{"laptop.alice.example.com.", "laptop-linux.example.com."},
+		},
+		{
+			name:      "tagged devices have no user",
+			templates: []string{"{{.Host}}.{{.User}}.{{.Domain}}", "{{.Host}}.{{.Domain}}"},
+			peer:      server,
+			expected:  []string{"server.example.com."},
+		},
+		{
+			name:      "tag kept verbatim",
+			templates: []string{"{{.Tag}}.{{.Host}}.{{.Domain}}"},
+			peer:      server,
+			expected:  []string{"web-eu.server.example.com.", "api.server.example.com."},
+		},
+		{
+			name:     "owner names",
+			owner:    true,
+			peer:     laptop,
+			expected: []string{"laptop.example.com.", "laptop.alice.example.com."},
+		},
+		{
+			name:     "owner login with dots",
+			owner:    true,
+			peer:     &ipnstate.PeerStatus{HostName: "laptop", UserID: 2},
+			expected: []string{"laptop.example.com.", "laptop.bob-smith.example.com."},
+		},
+		{
+			name:     "owner names skip tagged devices",
+			owner:    true,
+			peer:     &ipnstate.PeerStatus{HostName: "ci", UserID: 1, Tags: tags("tag:ci")},
+			expected: []string{"ci.example.com."},
+		},
+		{
+			name:      "owner names with templates",
+			templates: []string{"{{.Host}}-{{.OS}}.{{.Domain}}"},
+			owner:     true,
+			peer:      laptop,
+			expected:  []string{"laptop-linux.example.com.", "laptop.alice.example.com."},
+		},
+		{
+			name:     "dnsname source",
+			source:   nameSourceDNSName,
+			peer:     renamed,
+			expected: []string{"build-01.example.com.", "build-01.ci.example.com."},
+		},
+		{
+			name:     "both sources",
+			source:   nameSourceBoth,
+			peer:     renamed,
+			expected: []string{"laptop.example.com.", "laptop.ci.example.com.", "build-01.example.com.", "build-01.ci.example.com."},
+		},
+		{
+			name:     "dnsname source without MagicDNS name",
+			source:   nameSourceDNSName,
+			peer:     laptop,
+			expected: []string{"laptop.example.com."},
+		},
+		{
+			name:     "custom prefix",
+			prefix:   "tag:prod",
+			peer:     server,
+			expected: []string{"server.example.com."},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ts := newTailscale([]string{"example.com"})
+			for _, text := range tt.templates {
+				if ts.nameTemplates == nil {
+					ts.nameTemplates = make(map[string][]*nameTemplate)
+				}
+				ts.nameTemplates["example.com"] = append(ts.nameTemplates["example.com"], mustParseNameTemplate(text))
+			}
+			ts.ownerNames = tt.owner
+			if tt.source != "" {
+				ts.nameSource = tt.source
+			}
+			if tt.prefix != "" {
+				ts.subdomainTagPrefix = tt.prefix
+			}
+
+			names := ts.nodeNames(tt.peer, status, "example.com", nil)
+			if !reflect.DeepEqual(names, tt.expected) {
+				t.Errorf("Expected names %v but got %v", tt.expected, names)
+			}
+		})
+	}
+}
+
+func TestSanitizeLabel(t *testing.T) {
+	tests := []struct {
+		input    string
+		expected string
+	}{
+		{input: "web", expected: "web"},
+		{input: "Alice's MacBook Pro", expected: "alice-s-macbook-pro"},
+		{input: "build_agent.01", expected: "build-agent-01"},
+		{input: "--edge--", expected: "edge"},
+		{input: "Café", expected: "xn--caf-dma"},
+		{input: "ノートPC", expected: "xn--pc-pj4axa4u"},
+		{input: "___", expected: ""},
+		{input: "a123456789b123456789c123456789d123456789e123456789f123456789g123456789", expected: "a123456789b123456789c123456789d123456789e123456789f123456789g12"},
+	}
+
+	for _, tt := range tests {
+		if got := sanitizeLabel(tt.input); got != tt.expected {
+			t.Errorf("sanitizeLabel(%q): expected %q but got %q", tt.input, tt.expected, got)
+		}
+	}
+}
+
+func TestBuildRecordsCollisions(t *testing.T) {
+	created := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	status := &ipnstate.Status{
+		Self: &ipnstate.PeerStatus{
+			HostName:     "ts-dns",
+			TailscaleIPs: []netip.Addr{netip.MustParseAddr("100.64.0.1")},
+		},
+		Peer: map[key.NodePublic]*ipnstate.PeerStatus{
+			key.NewNode().Public(): {
+				ID:           "n2",
+				HostName:     "laptop",
+				DNSName:      "laptop-1.tailnet.ts.net.",
+				Created:      created.Add(time.Hour),
+				TailscaleIPs: []netip.Addr{netip.MustParseAddr("100.64.0.3")},
+			},
+			key.NewNode().Public(): {
+				ID:           "n1",
+				HostName:     "Laptop",
+				DNSName:      "laptop.tailnet.ts.net.",
+				Created:      created,
+				TailscaleIPs: []netip.Addr{netip.MustParseAddr("100.64.0.2")},
+			},
+			key.NewNode().Public(): {
+				ID:           "n3",
+				HostName:     "laptop",
+				Created:      created.Add(2 * time.Hour),
+				TailscaleIPs: []netip.Addr{netip.MustParseAddr("100.64.0.4")},
+			},
+			key.NewNode().Public(): {
+				ID:           "n4",
+				HostName:     "ts-dns",
+				DNSName:      "ts-dns-1.tailnet.ts.net.",
+				TailscaleIPs: []netip.Addr{netip.MustParseAddr("100.64.0.5")},
+			},
+		},
+	}
+
+	expected := map[string]string{
+		"ts-dns.example.com.":   "100.64.0.1",
+		"laptop.example.com.":   "100.64.0.2",
+		"laptop-1.example.com.": "100.64.0.3",
+		"ts-dns-1.example.com.": "100.64.0.5",
+	}
+
+	// The result must not depend on map iteration order.
+	for i := 0; i < 10; i++ {
+		table := newTailscale([]string{"example.com"}).buildRecords(status)
+
+		got := make(map[string]string)
+		for name, rec := range table.Records {
+			for _, addr := range rec.Addrs {
+				got[name] = addr.String()
+			}
+		}
+		if !reflect.DeepEqual(got, expected) {
+			t.Fatalf("Expected records %v but got %v", expected, got)
+		}
+	}
+}
+
+func TestBuildRecordsAliasCollisions(t *testing.T) {
+	created := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	status := &ipnstate.Status{
+		Self: &ipnstate.PeerStatus{
+			HostName:     "ts-dns",
+			TailscaleIPs: []netip.Addr{netip.MustParseAddr("100.64.0.1")},
+		},
+		Peer: map[key.NodePublic]*ipnstate.PeerStatus{
+			key.NewNode().Public(): {
+				ID:           "n2",
+				HostName:     "web-new",
+				Created:      created.Add(time.Hour),
+				Tags:         tags("tag:cname-app"),
+				TailscaleIPs: []netip.Addr{netip.MustParseAddr("100.64.0.3")},
+			},
+			key.NewNode().Public(): {
+				ID:           "n1",
+				HostName:     "web-old",
+				Created:      created,
+				Tags:         tags("tag:cname-app"),
+				TailscaleIPs: []netip.Addr{netip.MustParseAddr("100.64.0.2")},
+			},
+		},
+	}
+
+	// The result must not depend on map iteration order.
+	for i := 0; i < 10; i++ {
+		table := newTailscale([]string{"aliases.example.com"}).buildRecords(status)
+		if target := table.Aliases["app.aliases.example.com."]; target != "web-old.aliases.example.com." {
+			t.Fatalf("Expected app.aliases.example.com. to point at web-old.aliases.example.com. but got %q", target)
+		}
+		if got := testutil.ToFloat64(nameCollisions.WithLabelValues("aliases.example.com.")); got != 1 {
+			t.Fatalf("Expected 1 collision but got %v", got)
+		}
+	}
+}
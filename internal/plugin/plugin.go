@@ -2,60 +2,187 @@ package plugin
 
 import (
 	"context"
+	"errors"
 	"fmt"
-	"net"
+	"io/fs"
 	"os"
+	"reflect"
 	"strconv"
-	"strings"
 	"sync"
 	"time"
 
-	"net/netip"
-
 	"tailscale.com/client/tailscale"
 	"tailscale.com/ipn/ipnstate"
+	"tailscale.com/tailcfg"
 
 	"github.com/coredns/coredns/plugin"
+	"github.com/coredns/coredns/plugin/pkg/fall"
 	clog "github.com/coredns/coredns/plugin/pkg/log"
+	"github.com/miekg/dns"
 
 	"tailscale-coredns/pkg/api"
 )
 
-type record struct {
-	IPv4 net.IP
-	IPv6 net.IP
-}
+// Defaults of the ttl, socket and staleness options.
+const (
+	defaultTTL       = 60
+	defaultSocket    = "/run/tailscale/tailscaled.sock"
+	defaultStaleness = 5 * time.Minute
+)
+
+// initialRefreshTimeout bounds the status read done at startup.
+const initialRefreshTimeout = 10 * time.Second
 
 type Tailscale struct {
 	Next    plugin.Handler
-	Domains []string // Changed from Domain to Domains (plural)
-	records map[string]record
+	Domains []string     // Changed from Domain to Domains (plural)
+	zones   []string     // Domains as fully qualified zone names
+	table   *recordTable // records of the last successful refresh
+	serial  uint32       // SOA serial of the current record table
+	updated time.Time    // time of the last successful refresh, zero before the first
+	stale   bool         // table was loaded from a snapshot and not refreshed yet
 	mu      sync.RWMutex
 	lc      *tailscale.LocalClient
 	api     *api.Client
+	// Record options
+	ttl             uint32        // TTL of every answer, also the SOA minimum
+	refreshInterval time.Duration // time between two status polls
+	refresher       *refresher    // shared status reader, set between startup and shutdown
+	staleness       time.Duration // records older than this make the plugin not ready; 0 disables
+	snapshotPath    string        // file the records are persisted to; empty disables
+	staleTTL        uint32        // TTL of answers served from a snapshot
+	notifier        notifier      // announces record changes to secondaries; nil without transfer
+	dnssec          *zoneSigner   // signs answers of zones with keys; nil disables DNSSEC
+	whois           *whoisCache   // identities of query sources
+	// aclCapability is the capability granting queriers the nodes they may
+	// resolve; empty answers every querier with every node
+	aclCapability        tailcfg.PeerCapability
+	aclPolicy            bool           // queriers resolve the nodes the tailnet policy lets them reach
+	policy               *tailnetPolicy // last policy read for aclPolicy; nil grants nothing
+	fetchPolicy          policyFunc     // reads the policy; nil without aclPolicy
+	lastPolicyCheck      time.Time      // time of the last policy read
+	aclAllowUnidentified bool           // sources that are not tailnet nodes see every node
+	lan                  lanSources     // alternate addresses for clients outside the tailnet
+	families             []string       // address families to publish, in answer order
+	fall                 fall.F         // zones where unknown names are passed to the next plugin
+	cnames               []cnameMapping
+	filter               nodeFilter    // peers to publish
+	warnings             buildWarnings // problems found by the last record builds, logged once
+	// domainSelectors restricts the peers published in a domain
+	domainSelectors map[string][]selector
+	// nameTemplates replaces the default name templates of a domain
+	nameTemplates      map[string][]*nameTemplate
+	subdomainTagPrefix string
+	ownerNames         bool   // also publish owned devices as host.user.domain
+	nameSource         string // where {{.Host}} comes from
 	// Split DNS management
-	enableSplitDNS   bool
-	splitDNSDomains  []string // Changed from splitDNSDomain to splitDNSDomains
-	ownIP            string
-	lastVerifiedIP   string
+	enableSplitDNS    bool
+	splitDNSDomains   []string // Changed from splitDNSDomain to splitDNSDomains
+	ownIP             string
+	lastVerifiedIP    string
 	lastSplitDNSCheck time.Time
+	// nameservers holds the split DNS nameserver IPs per domain, as last read from the API
+	nameservers map[string][]string
 }
 
+// New creates a Tailscale plugin instance for the given domains with split DNS
+// initialized. Its records are not refreshed; it is meant for managing split DNS.
 func New(domains []string) (*Tailscale, error) {
-	ts := &Tailscale{
-		Domains: domains,
-		records: make(map[string]record),
-		lc:      &tailscale.LocalClient{Socket: "/run/tailscale/tailscaled.sock"},
+	ts := newTailscale(domains)
+	ts.initialize()
+	return ts, nil
+}
+
+// newTailscale creates a Tailscale plugin instance with default settings.
+// Options may be changed until OnStartup is called.
+func newTailscale(domains []string) *Tailscale {
+	zones := make([]string, len(domains))
+	for i, domain := range domains {
+		zones[i] = dns.Fqdn(domain)
+	}
+
+	lc := &tailscale.LocalClient{Socket: defaultSocket}
+	return &Tailscale{
+		Domains:   domains,
+		zones:     zones,
+		table:     newRecordTable(),
+		ttl:       defaultTTL,
+		staleness: defaultStaleness,
+		staleTTL:  defaultStaleTTL,
+		families:  []string{familyIPv4, familyIPv6},
+		filter:    nodeFilter{hiddenTag: defaultHiddenTag},
+
+		subdomainTagPrefix: defaultSubdomainTagPrefix,
+		nameSource:         nameSourceHostName,
+		refreshInterval:    getRefreshInterval(),
+		lc:                 lc,
+		whois:              newWhoisCache(lc.WhoIs),
 	}
+}
 
-	// Initialize split DNS if enabled
-	if err := ts.initializeSplitDNS(); err != nil {
+// initialize sets up split DNS if it is enabled.
+func (t *Tailscale) initialize() {
+	if err := t.initializeSplitDNS(); err != nil {
 		clog.Errorf("Failed to initialize split DNS: %v", err)
 		// Continue without split DNS if initialization fails
 	}
+}
 
-	go ts.periodicRefresh()
-	return ts, nil
+// OnStartup starts refreshing the records, driven by tailscaled notifications
+// and by polling. Instances using the same socket share one refresher.
+// The snapshot, if any, is loaded and the status is read once before returning,
+// so that the records are available when the server starts answering.
+func (t *Tailscale) OnStartup() error {
+	if t.snapshotPath != "" {
+		if err := t.loadSnapshot(); err == nil {
+			clog.Infof("serving records from snapshot %s until tailscaled responds", t.snapshotPath)
+		} else if !errors.Is(err, fs.ErrNotExist) {
+			clog.Warningf("failed to load snapshot: %v", err)
+		}
+	}
+
+	t.raiseStaleness()
+	t.refresher = subscribe(t)
+
+	ctx, cancel := context.WithTimeout(context.Background(), initialRefreshTimeout)
+	defer cancel()
+	t.refresher.refresh(ctx)
+	return nil
+}
+
+// Ready implements ready.Readiness. The plugin is ready once a status has been
+// read, and stops being ready when no status could be read for longer than the
+// staleness window.
+func (t *Tailscale) Ready() bool {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+
+	if t.updated.IsZero() {
+		return false
+	}
+	return t.staleness == 0 || time.Since(t.updated) <= t.staleness
+}
+
+// raiseStaleness makes the staleness window longer than the refresh interval,
+// so that the plugin does not become not ready between two successful polls.
+func (t *Tailscale) raiseStaleness() {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if t.staleness != 0 && t.staleness <= t.refreshInterval {
+		clog.Warningf("staleness %s is not longer than the refresh interval %s, using %s", t.staleness, t.refreshInterval, 2*t.refreshInterval)
+		t.staleness = 2 * t.refreshInterval
+	}
+}
+
+// OnShutdown stops refreshing the records. The shared refresher stops with its
+// last instance, so a reload does not leave pollers behind.
+func (t *Tailscale) OnShutdown() error {
+	if t.refresher != nil {
+		t.refresher.unsubscribe(t)
+		t.refresher = nil
+	}
+	return nil
 }
 
 // initializeSplitDNS sets up split DNS functionality if enabled
@@ -65,26 +192,50 @@ func (t *Tailscale) initializeSplitDNS() error {
 		return nil
 	}
 
-	// Get OAuth credentials
+	// Create API client
+	client, err := newAPIClient()
+	if err != nil {
+		return fmt.Errorf("%w for split DNS", err)
+	}
+	t.api = client
+	t.enableSplitDNS = true
+	t.splitDNSDomains = t.Domains
+
+	clog.Infof("Split DNS enabled for domains: %v", t.splitDNSDomains)
+	return nil
+}
+
+// initializePolicy sets up reading the tailnet policy for the acl policy option,
+// sharing the API client of split DNS when it is enabled.
+func (t *Tailscale) initializePolicy() error {
+	if !t.aclPolicy {
+		return nil
+	}
+	if t.api == nil {
+		client, err := newAPIClient()
+		if err != nil {
+			return fmt.Errorf("%w for acl policy", err)
+		}
+		t.api = client
+	}
+	t.fetchPolicy = t.api.GetPolicy
+	return nil
+}
+
+// newAPIClient creates a Tailscale API client from the OAuth credentials and
+// tailnet in the environment.
+func newAPIClient() (*api.Client, error) {
 	clientID := os.Getenv("TS_CLIENT_ID")
 	clientSecret := os.Getenv("TS_CLIENT_SECRET")
 	if clientID == "" || clientSecret == "" {
-		return fmt.Errorf("TS_CLIENT_ID and TS_CLIENT_SECRET are required for split DNS")
+		return nil, fmt.Errorf("TS_CLIENT_ID and TS_CLIENT_SECRET are required")
 	}
 
-	// Get tailnet from environment
 	tailnet, err := api.GetTailnetFromEnv()
 	if err != nil {
-		return fmt.Errorf("failed to get tailnet: %w", err)
+		return nil, fmt.Errorf("failed to get tailnet: %w", err)
 	}
-
-	// Create API client
-	t.api = api.NewClient(clientID, clientSecret, tailnet)
-	t.enableSplitDNS = true
-	t.splitDNSDomains = t.Domains
-
-	clog.Infof("Split DNS enabled for domains: %v", t.splitDNSDomains)
-	return nil
+	return api.NewClient(clientID, clientSecret, tailnet), nil
 }
 
 // GetOwnIP retrieves the current node's Tailscale IP
@@ -190,50 +341,71 @@ func getRefreshInterval() time.Duration {
 	return 30 * time.Second
 }
 
-// periodicRefresh periodically updates the DNS records.
-// Using a ticker allows for better control and cleanup if needed in the future.
-func (t *Tailscale) periodicRefresh() {
-	interval := getRefreshInterval()
-	ticker := time.NewTicker(interval)
-	for range ticker.C {
-		t.refresh()
+// update rebuilds the local DNS records from a Tailscale status.
+// This ensures that DNS queries reflect the latest network state.
+func (t *Tailscale) update(status *ipnstate.Status) {
+	if err := t.lan.reload(); err != nil {
+		t.warnings.warningf("failed to read lan_map, keeping the previous mapping: %v", err)
 	}
-}
+	table := t.buildRecords(status)
+	changed := t.setTable(table)
 
-// refresh fetches the current Tailscale status and updates the local DNS records.
-// This ensures that DNS queries reflect the latest network state.
-func (t *Tailscale) refresh() {
-	ctx := context.Background()
-	status, err := t.lc.Status(ctx)
-	if err != nil {
-		clog.Errorf("failed to get Tailscale status: %v", err)
-		return
+	t.mu.Lock()
+	t.updated = time.Now()
+	t.stale = false
+	t.mu.Unlock()
+
+	if changed && t.snapshotPath != "" {
+		if err := t.saveSnapshot(); err != nil {
+			clog.Errorf("failed to save snapshot: %v", err)
+		}
 	}
-	if status == nil || status.Self == nil {
-		clog.Warning("received nil status or self node from Tailscale")
-		return
+	if changed {
+		t.notify()
+		t.whois.clear()
+	}
+
+	counts := recordCounts(table, t.zones)
+	for _, zone := range t.zones {
+		recordsPublished.WithLabelValues(zone).Set(float64(counts[zone]))
+		staleRecords.WithLabelValues(zone).Set(0)
 	}
 
-	newRecords := make(map[string]record)
+	// Periodically verify and update split DNS
+	t.verifySplitDNS()
+	t.refreshPolicy()
+}
+
+// setTable replaces the record table and reports whether it changed. The SOA
+// serial is advanced only when the new table differs from the current one, so
+// secondaries and caches see a change exactly when the published records change.
+func (t *Tailscale) setTable(table *recordTable) bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
 
-	// Process self node for all domains
-	for _, domain := range t.Domains {
-		t.processNodeForDomain(newRecords, status.Self, domain)
+	if t.serial != 0 && reflect.DeepEqual(t.table, table) {
+		return false
 	}
 
-	// Process peer nodes for all domains
-	for _, peer := range status.Peer {
-		for _, domain := range t.Domains {
-			t.processNodeForDomain(newRecords, peer, domain)
-		}
+	t.table = table
+	serial := uint32(time.Now().Unix())
+	if serial <= t.serial {
+		serial = t.serial + 1
 	}
+	t.serial = serial
+	return true
+}
 
-	t.mu.Lock()
-	t.records = newRecords
-	t.mu.Unlock()
+// current returns the record table, its serial and the TTL to answer with.
+func (t *Tailscale) current() (*recordTable, uint32, uint32) {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
 
-	// Periodically verify and update split DNS
-	t.verifySplitDNS()
+	ttl := t.ttl
+	if t.stale {
+		ttl = min(ttl, t.staleTTL)
+	}
+	return t.table, t.serial, ttl
 }
 
 // verifySplitDNS checks if split DNS is properly configured and updates it if needed
@@ -253,6 +425,7 @@ func (t *Tailscale) verifySplitDNS() {
 	currentIP, err := t.GetOwnIP()
 	if err != nil {
 		clog.Errorf("Failed to get own IP for split DNS verification: %v", err)
+		splitDNSVerifications.WithLabelValues("error").Inc()
 		return
 	}
 
@@ -271,17 +444,26 @@ func (t *Tailscale) verifySplitDNS() {
 		shouldUpdate = true
 	}
 
-	if !shouldUpdate {
-		return
-	}
-
-	// Verify all domains are in split DNS with our IP
+	// Read the split DNS config on every check; the registered nameservers
+	// also provide the NS records of the domains
 	ctx := context.Background()
 	splitDNSConfig, err := t.api.GetSplitDNS(ctx)
 	if err != nil {
 		clog.Errorf("Failed to get split DNS config: %v", err)
+		splitDNSVerifications.WithLabelValues("error").Inc()
 		return
 	}
+	t.nameservers = make(map[string][]string, len(t.splitDNSDomains))
+	for _, domain := range t.splitDNSDomains {
+		t.nameservers[domain] = splitDNSConfig[domain]
+	}
+
+	if !shouldUpdate {
+		splitDNSVerifications.WithLabelValues("unchanged").Inc()
+		return
+	}
+
+	// Verify all domains are in split DNS with our IP
 
 	// Check each domain
 	needsUpdate := false
@@ -308,46 +490,17 @@ func (t *Tailscale) verifySplitDNS() {
 		clog.Info("Re-adding IP to split DNS domains...")
 		if err := t.AddToSplitDNS(); err != nil {
 			clog.Errorf("Failed to re-add IP to split DNS: %v", err)
+			splitDNSVerifications.WithLabelValues("error").Inc()
 			return
 		}
+		splitDNSVerifications.WithLabelValues("updated").Inc()
 	} else {
 		clog.Debugf("Split DNS verification successful for all domains")
+		splitDNSVerifications.WithLabelValues("ok").Inc()
 	}
 
 	// Update last verified IP
 	t.lastVerifiedIP = currentIP
 }
 
-// processNodeForDomain adds DNS records for a given node and domain, including any subdomain tags.
-func (t *Tailscale) processNodeForDomain(records map[string]record, peer *ipnstate.PeerStatus, domain string) {
-	host := strings.ToLower(peer.HostName)
-	fqdn := host + "." + domain + "."
-	records[fqdn] = t.ipsToRecord(peer.TailscaleIPs)
-
-	if peer.Tags != nil {
-		for _, tag := range peer.Tags.AsSlice() {
-			if strings.HasPrefix(tag, "tag:subdomain-") {
-				sub := strings.TrimPrefix(tag, "tag:subdomain-")
-				sub = strings.ReplaceAll(sub, "-", ".")
-				subFqdn := host + "." + sub + "." + domain + "."
-				records[subFqdn] = t.ipsToRecord(peer.TailscaleIPs)
-			}
-		}
-	}
-}
-
-// ipsToRecord converts a list of IP addresses to a record struct,
-// selecting the first IPv4 and IPv6 addresses found.
-func (t *Tailscale) ipsToRecord(ips []netip.Addr) record {
-	var ipv4, ipv6 net.IP
-	for _, ip := range ips {
-		if ip.Is4() && ipv4 == nil {
-			ipv4 = ip.AsSlice()
-		} else if ip.Is6() && ipv6 == nil {
-			ipv6 = ip.AsSlice()
-		}
-	}
-	return record{IPv4: ipv4, IPv6: ipv6}
-}
-
-func (t *Tailscale) Name() string { return "tailscale" }
\ No newline at end of file
+func (t *Tailscale) Name() string { return "tailscale" }
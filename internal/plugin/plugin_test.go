@@ -0,0 +1,57 @@
+package plugin
+
+import (
+	"testing"
+	"time"
+)
+
+func TestReady(t *testing.T) {
+	ts := newTailscale([]string{"example.com"})
+	if ts.Ready() {
+		t.Errorf("Expected not ready before the first refresh")
+	}
+
+	ts.update(testStatus())
+	if !ts.Ready() {
+		t.Errorf("Expected ready after a refresh")
+	}
+
+	ts.updated = time.Now().Add(-2 * defaultStaleness)
+	if ts.Ready() {
+		t.Errorf("Expected not ready with records older than the staleness window")
+	}
+
+	ts.staleness = 0
+	if !ts.Ready() {
+		t.Errorf("Expected ready with the staleness check disabled")
+	}
+}
+
+func TestRaiseStaleness(t *testing.T) {
+	tests := []struct {
+		refresh   time.Duration
+		staleness time.Duration
+		expected  time.Duration
+	}{
+		{refresh: 10 * time.Minute, staleness: defaultStaleness, expected: 20 * time.Minute},
+		{refresh: defaultStaleness, staleness: defaultStaleness, expected: 2 * defaultStaleness},
+		{refresh: 30 * time.Second, staleness: defaultStaleness, expected: defaultStaleness},
+		{refresh: 10 * time.Minute, staleness: 0, expected: 0},
+	}
+
+	for _, tt := range tests {
+		ts := newTailscale([]string{"example.com"})
+		ts.refreshInterval = tt.refresh
+		ts.staleness = tt.staleness
+		ts.raiseStaleness()
+		if ts.staleness != tt.expected {
+			t.Errorf("Expected staleness %s with refresh %s but got %s", tt.expected, tt.refresh, ts.staleness)
+		}
+
+		// A poll just before the next one is due keeps the plugin ready
+		ts.updated = time.Now().Add(-tt.refresh + time.Second)
+		if !ts.Ready() {
+			t.Errorf("Expected ready between polls with refresh %s and staleness %s", tt.refresh, ts.staleness)
+		}
+	}
+}
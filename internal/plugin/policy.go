@@ -0,0 +1,205 @@
+package plugin
+
+import (
+	"context"
+	"encoding/json"
+	"net/netip"
+	"slices"
+	"strings"
+	"time"
+
+	clog "github.com/coredns/coredns/plugin/pkg/log"
+	"tailscale.com/client/tailscale/apitype"
+)
+
+// aclPolicyMode is the argument of the acl option that derives each querier's
+// view from the tailnet policy instead of a capability.
+const aclPolicyMode = "policy"
+
+// Timing of policy reads from the Tailscale API.
+const (
+	policyRefreshInterval = time.Minute
+	policyFetchTimeout    = 10 * time.Second
+)
+
+// policyFunc reads the tailnet policy file as JSON.
+type policyFunc func(ctx context.Context) ([]byte, error)
+
+// tailnetPolicy is the part of the tailnet policy file that decides which
+// devices can reach which.
+type tailnetPolicy struct {
+	Groups map[string][]string `json:"groups"`
+	Hosts  map[string]string   `json:"hosts"`
+	ACLs   []policyRule        `json:"acls"`
+	Grants []policyRule        `json:"grants"`
+}
+
+// policyRule is an entry of the acls or grants section. ACLs written in the
+// legacy format use users and ports instead of src and dst.
+type policyRule struct {
+	Action     string   `json:"action"`
+	Src        []string `json:"src"`
+	Dst        []string `json:"dst"`
+	Users      []string `json:"users"`
+	Ports      []string `json:"ports"`
+	IP         []string `json:"ip"`
+	SrcPosture []string `json:"srcPosture"`
+}
+
+// parsePolicy parses a policy file returned by the API.
+func parsePolicy(data []byte) (*tailnetPolicy, error) {
+	var policy tailnetPolicy
+	if err := json.Unmarshal(data, &policy); err != nil {
+		return nil, err
+	}
+	return &policy, nil
+}
+
+// grant adds to v the devices that the querier who may reach under the
+// policy. Rules with device posture conditions are skipped, since the
+// querier's posture is unknown. A nil policy grants nothing.
+func (p *tailnetPolicy) grant(v *view, who *apitype.WhoIsResponse) {
+	if p == nil {
+		return
+	}
+
+	matches := func(src []string) bool {
+		return slices.ContainsFunc(src, func(s string) bool { return p.matchesSource(s, v, who) })
+	}
+	for _, rule := range p.ACLs {
+		if !strings.EqualFold(rule.Action, "accept") || len(rule.SrcPosture) > 0 || !matches(append(slices.Clip(rule.Src), rule.Users...)) {
+			continue
+		}
+		for _, target := range append(slices.Clip(rule.Dst), rule.Ports...) {
+			p.addTarget(v, stripPorts(target))
+		}
+	}
+	// Grants without ip only carry application capabilities
+	for _, rule := range p.Grants {
+		if len(rule.IP) == 0 || len(rule.SrcPosture) > 0 || !matches(rule.Src) {
+			continue
+		}
+		for _, target := range rule.Dst {
+			p.addTarget(v, target)
+		}
+	}
+}
+
+// matchesSource reports whether the policy source src covers the querier.
+func (p *tailnetPolicy) matchesSource(src string, v *view, who *apitype.WhoIsResponse) bool {
+	tagged := who.Node.IsTagged()
+	switch {
+	case src == "*":
+		return true
+	case src == "autogroup:member":
+		return !tagged
+	case src == "autogroup:tagged":
+		return tagged
+	case strings.HasPrefix(src, "tag:"):
+		return slices.Contains(who.Node.Tags, src)
+	case strings.HasPrefix(src, "group:"):
+		return v.user != "" && slices.ContainsFunc(p.Groups[src], func(member string) bool {
+			return strings.EqualFold(member, v.user)
+		})
+	case strings.HasPrefix(src, "autogroup:"):
+		// Roles and other autogroups cannot be resolved from the querier's identity
+		return false
+	case strings.Contains(src, "@"):
+		return v.user != "" && strings.EqualFold(src, v.user)
+	}
+
+	prefix, ok := p.prefix(src)
+	if !ok {
+		return false
+	}
+	for _, addr := range who.Node.Addresses {
+		if prefix.Contains(addr.Addr()) {
+			return true
+		}
+	}
+	return false
+}
+
+// addTarget adds the devices of a policy destination to v.
+// Destinations that are not devices, such as autogroup:internet, are ignored.
+func (p *tailnetPolicy) addTarget(v *view, target string) {
+	switch {
+	case target == "*":
+		v.all = true
+	case target == "autogroup:self":
+		v.self = true
+	case target == "autogroup:member":
+		v.members = true
+	case target == "autogroup:tagged":
+		v.tagged = true
+	case strings.HasPrefix(target, "tag:"):
+		v.selectors = append(v.selectors, selector{kind: "tag", value: strings.ToLower(strings.TrimPrefix(target, "tag:"))})
+	case strings.HasPrefix(target, "group:"):
+		for _, member := range p.Groups[target] {
+			v.selectors = append(v.selectors, selector{kind: "user", value: strings.ToLower(member)})
+		}
+	case strings.HasPrefix(target, "autogroup:"):
+	case strings.Contains(target, "@"):
+		v.selectors = append(v.selectors, selector{kind: "user", value: strings.ToLower(target)})
+	default:
+		if prefix, ok := p.prefix(target); ok {
+			v.prefixes = append(v.prefixes, prefix)
+		}
+	}
+}
+
+// prefix resolves a host alias, address or CIDR of the policy.
+func (p *tailnetPolicy) prefix(s string) (netip.Prefix, bool) {
+	if host, ok := p.Hosts[s]; ok {
+		s = host
+	}
+	if prefix, err := netip.ParsePrefix(s); err == nil {
+		return prefix.Masked(), true
+	}
+	if addr, err := netip.ParseAddr(s); err == nil {
+		return netip.PrefixFrom(addr, addr.BitLen()), true
+	}
+	return netip.Prefix{}, false
+}
+
+// stripPorts removes the port list from an ACL destination such as
+// tag:web:443, [fd7a:115c:a1e0::1]:* or 10.0.0.0/8:22.
+func stripPorts(target string) string {
+	host := target
+	if i := strings.LastIndex(target, ":"); i >= 0 {
+		host = target[:i]
+	}
+	return strings.TrimSuffix(strings.TrimPrefix(host, "["), "]")
+}
+
+// refreshPolicy reads the tailnet policy again when the last read is older
+// than policyRefreshInterval. On failure the previous policy is kept.
+func (t *Tailscale) refreshPolicy() {
+	if t.fetchPolicy == nil {
+		return
+	}
+
+	now := time.Now()
+	if now.Sub(t.lastPolicyCheck) < policyRefreshInterval {
+		return
+	}
+	t.lastPolicyCheck = now
+
+	ctx, cancel := context.WithTimeout(context.Background(), policyFetchTimeout)
+	defer cancel()
+
+	data, err := t.fetchPolicy(ctx)
+	if err != nil {
+		clog.Errorf("failed to read the tailnet policy: %v", err)
+		return
+	}
+	policy, err := parsePolicy(data)
+	if err != nil {
+		clog.Errorf("failed to parse the tailnet policy: %v", err)
+		return
+	}
+
+	t.mu.Lock()
+	t.policy = policy
+	t.mu.Unlock()
+}
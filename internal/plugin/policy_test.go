@@ -0,0 +1,183 @@
+package plugin
+
+import (
+	"context"
+	"errors"
+	"net/netip"
+	"testing"
+
+	"github.com/miekg/dns"
+	"tailscale.com/client/tailscale/apitype"
+	"tailscale.com/tailcfg"
+)
+
+// testPolicy lets group:dev reach tag:web and its own devices, tag:ci reach
+// db-host, and 100.64.0.10 reach tag:web through a grant.
+const testPolicy = `{
+	"groups": {"group:dev": ["alice@example.com"]},
+	"hosts": {"db-host": "100.64.0.3"},
+	"acls": [
+		{"action": "accept", "src": ["group:dev"], "dst": ["tag:web:443", "autogroup:self:*"]},
+		{"action": "accept", "src": ["tag:ci"], "dst": ["db-host:5432"]},
+		{"action": "accept", "src": ["autogroup:member"], "dst": ["*:*"], "srcPosture": ["posture:latest"]}
+	],
+	"grants": [
+		{"src": ["100.64.0.10"], "dst": ["tag:web"], "ip": ["tcp:443"]},
+		{"src": ["*"], "dst": ["*"], "app": {"example.com/cap/other": [{}]}}
+	]
+}`
+
+// testPolicyQueriers maps source addresses to the identities of policy test queriers.
+var testPolicyQueriers = map[string]*apitype.WhoIsResponse{
+	"100.64.0.9": {
+		Node:        &tailcfg.Node{StableID: "alice-laptop", Addresses: []netip.Prefix{netip.MustParsePrefix("100.64.0.9/32")}},
+		UserProfile: &tailcfg.UserProfile{LoginName: "alice@example.com"},
+	},
+	"100.64.0.10": {
+		Node:        &tailcfg.Node{StableID: "ci", Tags: []string{"tag:ci"}, Addresses: []netip.Prefix{netip.MustParsePrefix("100.64.0.10/32")}},
+		UserProfile: &tailcfg.UserProfile{LoginName: "tagged-devices"},
+	},
+	"100.64.0.6": {
+		Node:        &tailcfg.Node{StableID: "bob-pc", Addresses: []netip.Prefix{netip.MustParsePrefix("100.64.0.6/32")}},
+		UserProfile: &tailcfg.UserProfile{LoginName: "bob@example.com"},
+	},
+}
+
+// testPolicyWhois identifies the queriers of testPolicyQueriers.
+func testPolicyWhois(ctx context.Context, addr string) (*apitype.WhoIsResponse, error) {
+	if who, ok := testPolicyQueriers[addr]; ok {
+		return who, nil
+	}
+	return nil, errors.New("no match for IP")
+}
+
+func TestPolicyGrant(t *testing.T) {
+	policy, err := parsePolicy([]byte(testPolicy))
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	table := newRecordTable()
+	table.Nodes = map[netip.Addr]nodeIdentity{
+		netip.MustParseAddr("100.64.0.2"): {ID: "web", Tags: []string{"tag:web"}},
+		netip.MustParseAddr("100.64.0.3"): {ID: "db", Tags: []string{"tag:db"}},
+		netip.MustParseAddr("100.64.0.5"): {ID: "alice-pc", User: "alice@example.com"},
+		netip.MustParseAddr("100.64.0.6"): {ID: "bob-pc", User: "bob@example.com"},
+	}
+
+	tests := []struct {
+		name     string
+		source   string
+		expected map[string]bool
+	}{
+		{
+			name:     "group member reaches a tag and its own devices",
+			source:   "100.64.0.9",
+			expected: map[string]bool{"100.64.0.2": true, "100.64.0.3": false, "100.64.0.5": true, "100.64.0.6": false},
+		},
+		{
+			name:     "tagged device reaches a host alias and a grant destination",
+			source:   "100.64.0.10",
+			expected: map[string]bool{"100.64.0.2": true, "100.64.0.3": true, "100.64.0.5": false, "100.64.0.6": false},
+		},
+		{
+			name:     "rules with posture conditions are skipped",
+			source:   "100.64.0.6",
+			expected: map[string]bool{"100.64.0.2": false, "100.64.0.3": false, "100.64.0.5": false, "100.64.0.6": true},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			who := testPolicyQueriers[tt.source]
+			v := &view{node: string(who.Node.StableID)}
+			if !who.Node.IsTagged() {
+				v.user = who.UserProfile.LoginName
+			}
+			policy.grant(v, who)
+
+			for addr, expected := range tt.expected {
+				if got := v.allowsAddr(table, netip.MustParseAddr(addr)); got != expected {
+					t.Errorf("Expected %s visible to be %v but got %v", addr, expected, got)
+				}
+			}
+		})
+	}
+}
+
+func TestStripPorts(t *testing.T) {
+	tests := map[string]string{
+		"tag:web:443":                "tag:web",
+		"*:*":                        "*",
+		"alice@example.com:22,80":    "alice@example.com",
+		"10.0.0.0/8:1000-2000":       "10.0.0.0/8",
+		"[fd7a:115c:a1e0::1]:*":      "fd7a:115c:a1e0::1",
+		"fd7a:115c:a1e0::1:22":       "fd7a:115c:a1e0::1",
+		"autogroup:self:*":           "autogroup:self",
+		"autogroup:internet:443,853": "autogroup:internet",
+	}
+
+	for target, expected := range tests {
+		if got := stripPorts(target); got != expected {
+			t.Errorf("Expected %s for %s but got %s", expected, target, got)
+		}
+	}
+}
+
+func TestServeDNSACLPolicy(t *testing.T) {
+	policy, err := parsePolicy([]byte(`{"acls": [{"action": "accept", "src": ["tag:ci"], "dst": ["tag:srv-postgres-tcp-5432:5432"]}]}`))
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	ts := newTestTailscale([]string{"example.com"}, testStatus(), func(ts *Tailscale) {
+		ts.aclPolicy = true
+		ts.policy = policy
+		ts.whois = newWhoisCache(testPolicyWhois)
+	})
+
+	m := queryFrom(t, ts, "100.64.0.10", "db.example.com.", dns.TypeA, dns.RcodeSuccess)
+	checkSection(t, "answer", m.Answer, []string{"db.example.com.\t60\tIN\tA\t100.64.0.3"})
+	queryFrom(t, ts, "100.64.0.10", "web.example.com.", dns.TypeA, dns.RcodeNameError)
+	queryFrom(t, ts, "100.64.0.9", "db.example.com.", dns.TypeA, dns.RcodeNameError)
+
+	// Without a policy nothing is granted
+	ts.policy = nil
+	queryFrom(t, ts, "100.64.0.10", "db.example.com.", dns.TypeA, dns.RcodeNameError)
+}
+
+func TestRefreshPolicy(t *testing.T) {
+	ts := newTailscale([]string{"example.com"})
+	ts.aclPolicy = true
+
+	calls := 0
+	response, fetchErr := testPolicy, error(nil)
+	ts.fetchPolicy = func(ctx context.Context) ([]byte, error) {
+		calls++
+		return []byte(response), fetchErr
+	}
+
+	ts.refreshPolicy()
+	if ts.policy == nil || len(ts.policy.ACLs) != 3 {
+		t.Fatalf("Expected the policy to be read but got %+v", ts.policy)
+	}
+
+	// Reads are rate limited
+	ts.refreshPolicy()
+	if calls != 1 {
+		t.Errorf("Expected 1 policy read but got %d", calls)
+	}
+
+	// Failed reads keep the previous policy
+	previous := ts.policy
+	for _, fail := range []func(){
+		func() { fetchErr = errors.New("status 500") },
+		func() { response, fetchErr = "{", nil },
+	} {
+		fail()
+		ts.lastPolicyCheck = ts.lastPolicyCheck.Add(-policyRefreshInterval)
+		ts.refreshPolicy()
+		if ts.policy != previous {
+			t.Errorf("Expected the previous policy to be kept but got %+v", ts.policy)
+		}
+	}
+}
@@ -0,0 +1,411 @@
+package plugin
+
+import (
+	"fmt"
+	"net"
+	"net/netip"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	clog "github.com/coredns/coredns/plugin/pkg/log"
+	"github.com/miekg/dns"
+	"tailscale.com/ipn/ipnstate"
+	"tailscale.com/net/tsaddr"
+)
+
+// Address families accepted by the families option.
+const (
+	familyIPv4 = "ipv4"
+	familyIPv6 = "ipv6"
+)
+
+// record holds every Tailscale address of a node, ordered by the configured address families.
+type record struct {
+	Addrs []netip.Addr
+}
+
+// ipv4 returns the IPv4 addresses of the record.
+func (r record) ipv4() []net.IP {
+	var ips []net.IP
+	for _, ip := range r.Addrs {
+		if ip.Is4() {
+			ips = append(ips, ip.AsSlice())
+		}
+	}
+	return ips
+}
+
+// ipv6 returns the IPv6 addresses of the record.
+func (r record) ipv6() []net.IP {
+	var ips []net.IP
+	for _, ip := range r.Addrs {
+		if ip.Is6() {
+			ips = append(ips, ip.AsSlice())
+		}
+	}
+	return ips
+}
+
+// cnameMapping is an alias configured with the cname option. Relative names
+// are expanded under every domain; the alias is published only in domains it
+// belongs to.
+type cnameMapping struct {
+	Alias  string
+	Target string
+}
+
+// srvTarget is one node offering a service advertised with a tag:srv- tag.
+type srvTarget struct {
+	Target string
+	Port   uint16
+}
+
+// nodeIdentity describes the node owning an address, for deciding which
+// queriers may see it.
+type nodeIdentity struct {
+	ID   string   // stable node ID
+	User string   // owner's login name
+	Tags []string // ACL tags; tagged nodes have no owner in the policy
+	OS   string
+	LAN  []netip.Addr // alternate addresses answered to clients outside the tailnet
+}
+
+// identityOf returns the identity of peer. Owners are looked up in status.
+func identityOf(peer *ipnstate.PeerStatus, status *ipnstate.Status) nodeIdentity {
+	node := nodeIdentity{ID: string(peer.ID), OS: peer.OS}
+	if user, ok := status.User[peer.UserID]; ok {
+		node.User = user.LoginName
+	}
+	if peer.Tags != nil {
+		node.Tags = peer.Tags.AsSlice()
+	}
+	return node
+}
+
+// recordTable holds the records synthesized from one Tailscale status.
+type recordTable struct {
+	Records  map[string]record           // FQDN -> node addresses
+	Groups   map[string]record           // service group FQDN -> addresses of all members
+	Aliases  map[string]string           // alias FQDN -> CNAME target
+	Services map[string][]srvTarget      // _service._proto FQDN -> nodes offering it
+	PTRs     map[string][]string         // reverse name -> node FQDNs
+	NS       map[string][]string         // zone -> name server FQDNs
+	Nodes    map[netip.Addr]nodeIdentity // published address -> owning node
+}
+
+// newRecordTable returns an empty record table.
+func newRecordTable() *recordTable {
+	return &recordTable{
+		Records:  make(map[string]record),
+		Groups:   make(map[string]record),
+		Aliases:  make(map[string]string),
+		Services: make(map[string][]srvTarget),
+		PTRs:     make(map[string][]string),
+		NS:       make(map[string][]string),
+		Nodes:    make(map[netip.Addr]nodeIdentity),
+	}
+}
+
+// buildWarnings logs the problems found while building records. Records are
+// rebuilt on every refresh, so a problem is logged when it first appears and
+// not again until a build no longer finds it.
+type buildWarnings struct {
+	mu       sync.Mutex
+	previous map[string]bool // warnings of the last completed build
+	current  map[string]bool // warnings of the build in progress
+}
+
+// warningf logs a warning unless the previous build reported it too.
+func (w *buildWarnings) warningf(format string, args ...any) {
+	msg := fmt.Sprintf(format, args...)
+
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.current == nil {
+		w.current = make(map[string]bool)
+	}
+	if w.current[msg] {
+		return
+	}
+	w.current[msg] = true
+	if !w.previous[msg] {
+		clog.Warning(msg)
+	}
+}
+
+// done completes a build, making its warnings the ones already reported.
+func (w *buildWarnings) done() {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.previous, w.current = w.current, nil
+}
+
+// buildRecords converts a Tailscale status into a record table.
+func (t *Tailscale) buildRecords(status *ipnstate.Status) *recordTable {
+	defer t.warnings.done()
+
+	table := newRecordTable()
+	claims := newNameClaims()
+
+	// Process the self node and then the peers for all domains, skipping
+	// filtered nodes. The self node goes through the same filter and domain
+	// selectors as peers. Peers are processed oldest first, so that a name
+	// shared by several nodes stays with the node that had it first.
+	now := time.Now()
+	for _, peer := range append([]*ipnstate.PeerStatus{status.Self}, sortedPeers(status)...) {
+		if !t.filter.allows(peer, status, now) {
+			continue
+		}
+		for _, domain := range t.Domains {
+			if selectors := t.domainSelectors[domain]; len(selectors) > 0 && !matchesAny(selectors, peer, status) {
+				continue
+			}
+			t.processNodeForDomain(table, claims, status, peer, domain)
+		}
+	}
+
+	for name := range table.PTRs {
+		sort.Strings(table.PTRs[name])
+	}
+
+	for name, targets := range table.Services {
+		sort.Slice(targets, func(i, j int) bool {
+			if targets[i].Target != targets[j].Target {
+				return targets[i].Target < targets[j].Target
+			}
+			return targets[i].Port < targets[j].Port
+		})
+		table.Services[name] = slices.Compact(targets)
+	}
+
+	for name, group := range table.Groups {
+		if _, ok := table.Records[name]; ok {
+			t.warnings.warningf("ignoring service group %s: name is already used by a node", name)
+			delete(table.Groups, name)
+			continue
+		}
+		table.Groups[name] = t.sortRecord(group)
+	}
+
+	// Configured aliases take precedence over tag aliases
+	for _, mapping := range t.cnames {
+		for _, domain := range t.Domains {
+			alias := qualify(mapping.Alias, domain)
+			if dns.IsSubDomain(domain+".", alias) {
+				table.Aliases[alias] = qualify(mapping.Target, domain)
+			}
+		}
+	}
+
+	// A name holding addresses cannot also be an alias
+	for alias := range table.Aliases {
+		_, isNode := table.Records[alias]
+		_, isGroup := table.Groups[alias]
+		if isNode || isGroup {
+			t.warnings.warningf("ignoring alias %s: name is already used by a node", alias)
+			delete(table.Aliases, alias)
+		}
+	}
+
+	for i, domain := range t.Domains {
+		table.NS[t.zones[i]] = t.nameserverNames(status, claims, domain)
+		nameCollisions.WithLabelValues(t.zones[i]).Set(float64(claims.collisions[domain]))
+	}
+
+	// Signed reverse zones are served by the name servers of the first domain
+	if t.dnssec != nil {
+		for _, zone := range t.dnssec.reverse {
+			table.NS[zone] = table.NS[t.zones[0]]
+		}
+	}
+
+	return table
+}
+
+// nameserverNames returns the names of the ts-dns instances serving domain.
+// Instances registered in split DNS are looked up by their Tailscale IP; when
+// none of them is known, the local node's own name is used.
+func (t *Tailscale) nameserverNames(status *ipnstate.Status, claims *nameClaims, domain string) []string {
+	var names []string
+	for _, ns := range t.nameservers[domain] {
+		ip, err := netip.ParseAddr(ns)
+		if err != nil {
+			continue
+		}
+		if node := nodeByIP(status, ip); node != nil {
+			if name := claims.primary[claimKey{node: node, domain: domain}]; name != "" {
+				names = append(names, name)
+			}
+		}
+	}
+
+	if len(names) == 0 {
+		if name := claims.primary[claimKey{node: status.Self, domain: domain}]; name != "" {
+			names = append(names, name)
+		}
+	}
+
+	slices.Sort(names)
+	return slices.Compact(names)
+}
+
+// processNodeForDomain adds DNS records for a given node and domain under every name
+// produced by the domain's name templates. The node's primary name is also registered
+// as the PTR target of each of its tailnet addresses and as the target of its tag aliases
+// and services.
+func (t *Tailscale) processNodeForDomain(table *recordTable, claims *nameClaims, status *ipnstate.Status, peer *ipnstate.PeerStatus, domain string) {
+	names := t.nodeNames(peer, status, domain, claims)
+	if len(names) == 0 {
+		return
+	}
+	fqdn := names[0]
+	rec := t.ipsToRecord(peer.TailscaleIPs)
+	for _, name := range names {
+		table.Records[name] = rec
+	}
+	node := identityOf(peer, status)
+	if t.lan.enabled() {
+		node.LAN = t.ipsToRecord(t.lan.addresses(peer)).Addrs
+	}
+	for _, ip := range rec.Addrs {
+		table.Nodes[ip] = node
+	}
+
+	for _, ip := range rec.Addrs {
+		if !isTailnetIP(ip) {
+			continue
+		}
+		rev, err := dns.ReverseAddr(ip.String())
+		if err != nil {
+			continue
+		}
+		table.PTRs[rev] = append(table.PTRs[rev], fqdn)
+	}
+
+	if peer.Tags != nil {
+		for _, tag := range peer.Tags.AsSlice() {
+			switch {
+			case strings.HasPrefix(tag, "tag:service-"):
+				group := strings.ToLower(strings.TrimPrefix(tag, "tag:service-")) + "." + domain + "."
+				table.Groups[group] = record{Addrs: append(table.Groups[group].Addrs, rec.Addrs...)}
+			case strings.HasPrefix(tag, "tag:cname-"):
+				alias := strings.ToLower(strings.TrimPrefix(tag, "tag:cname-")) + "." + domain + "."
+				// The first node claiming an alias keeps it
+				if target, ok := table.Aliases[alias]; ok && target != fqdn {
+					claims.collisions[domain]++
+					t.warnings.warningf("alias collision: %s of %s is already used by %s, not publishing it", alias, describeNode(peer), target)
+					continue
+				}
+				table.Aliases[alias] = fqdn
+			case strings.HasPrefix(tag, "tag:srv-"):
+				service, proto, port, ok := parseSRVTag(strings.TrimPrefix(tag, "tag:srv-"))
+				if !ok {
+					t.warnings.warningf("ignoring malformed service tag %s on %s", tag, peer.HostName)
+					continue
+				}
+				name := "_" + service + "._" + proto + "." + domain + "."
+				table.Services[name] = append(table.Services[name], srvTarget{Target: fqdn, Port: port})
+			}
+		}
+	}
+}
+
+// ipsToRecord converts a list of IP addresses to a record struct, keeping every
+// address of the configured families in the configured family order.
+func (t *Tailscale) ipsToRecord(ips []netip.Addr) record {
+	var addrs []netip.Addr
+	for _, family := range t.families {
+		for _, ip := range ips {
+			if (family == familyIPv4 && ip.Is4()) || (family == familyIPv6 && ip.Is6()) {
+				addrs = append(addrs, ip)
+			}
+		}
+	}
+	return record{Addrs: addrs}
+}
+
+// parseSRVTag splits the value of a tag:srv- tag, <service>-<proto>-<port>, into
+// its parts. The service name may itself contain hyphens.
+func parseSRVTag(value string) (service, proto string, port uint16, ok bool) {
+	parts := strings.Split(strings.ToLower(value), "-")
+	if len(parts) < 3 {
+		return "", "", 0, false
+	}
+
+	n, err := strconv.ParseUint(parts[len(parts)-1], 10, 16)
+	if err != nil || n == 0 {
+		return "", "", 0, false
+	}
+
+	service = strings.Join(parts[:len(parts)-2], "-")
+	proto = parts[len(parts)-2]
+	if service == "" || proto == "" {
+		return "", "", 0, false
+	}
+	return service, proto, uint16(n), true
+}
+
+// qualify returns name as a fully qualified name. Names without a trailing dot
+// are relative to domain.
+func qualify(name, domain string) string {
+	name = strings.ToLower(name)
+	if dns.IsFqdn(name) {
+		return name
+	}
+	return name + "." + domain + "."
+}
+
+// sortRecord orders the addresses of a record collected from several nodes by
+// the configured families and by address, dropping duplicates. The order does
+// not depend on the order in which the nodes were processed.
+func (t *Tailscale) sortRecord(rec record) record {
+	addrs := slices.Clone(rec.Addrs)
+	slices.SortFunc(addrs, func(a, b netip.Addr) int { return a.Compare(b) })
+	return t.ipsToRecord(slices.Compact(addrs))
+}
+
+// sortedPeers returns the peers of status ordered by registration time, then
+// by stable node ID.
+func sortedPeers(status *ipnstate.Status) []*ipnstate.PeerStatus {
+	peers := make([]*ipnstate.PeerStatus, 0, len(status.Peer))
+	for _, peer := range status.Peer {
+		peers = append(peers, peer)
+	}
+	slices.SortFunc(peers, func(a, b *ipnstate.PeerStatus) int {
+		if c := a.Created.Compare(b.Created); c != 0 {
+			return c
+		}
+		if c := strings.Compare(string(a.ID), string(b.ID)); c != 0 {
+			return c
+		}
+		return strings.Compare(a.PublicKey.String(), b.PublicKey.String())
+	})
+	return peers
+}
+
+// nodeByIP returns the node of status that owns ip, or nil.
+func nodeByIP(status *ipnstate.Status, ip netip.Addr) *ipnstate.PeerStatus {
+	for _, addr := range status.Self.TailscaleIPs {
+		if addr == ip {
+			return status.Self
+		}
+	}
+	for _, peer := range status.Peer {
+		for _, addr := range peer.TailscaleIPs {
+			if addr == ip {
+				return peer
+			}
+		}
+	}
+	return nil
+}
+
+// isTailnetIP reports whether ip belongs to the Tailscale CGNAT (100.64.0.0/10)
+// or ULA (fd7a:115c:a1e0::/48) ranges.
+func isTailnetIP(ip netip.Addr) bool {
+	return tsaddr.CGNATRange().Contains(ip) || tsaddr.TailscaleULARange().Contains(ip)
+}
@@ -0,0 +1,77 @@
+package plugin
+
+import (
+	"bytes"
+	golog "log"
+	"os"
+	"strings"
+	"testing"
+)
+
+func TestParseSRVTag(t *testing.T) {
+	tests := []struct {
+		value   string
+		service string
+		proto   string
+		port    uint16
+		ok      bool
+	}{
+		{value: "http-tcp-8080", service: "http", proto: "tcp", port: 8080, ok: true},
+		{value: "sip-udp-5060", service: "sip", proto: "udp", port: 5060, ok: true},
+		{value: "node-exporter-tcp-9100", service: "node-exporter", proto: "tcp", port: 9100, ok: true},
+		{value: "HTTP-TCP-80", service: "http", proto: "tcp", port: 80, ok: true},
+		{value: "tcp-8080"},
+		{value: "http-tcp-0"},
+		{value: "http-tcp-65536"},
+		{value: "http-tcp-web"},
+		{value: "-tcp-80"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.value, func(t *testing.T) {
+			service, proto, port, ok := parseSRVTag(tt.value)
+			if ok != tt.ok {
+				t.Fatalf("Expected ok %t but got %t", tt.ok, ok)
+			}
+			if service != tt.service || proto != tt.proto || port != tt.port {
+				t.Errorf("Expected %s/%s/%d but got %s/%s/%d", tt.service, tt.proto, tt.port, service, proto, port)
+			}
+		})
+	}
+}
+
+func TestBuildRecordsWarnings(t *testing.T) {
+	var buf bytes.Buffer
+	golog.SetOutput(&buf)
+	defer golog.SetOutput(os.Stderr)
+
+	malformed := testStatus()
+	for _, peer := range malformed.Peer {
+		if peer.HostName == "db" {
+			peer.Tags = tags("tag:srv-http-tcp-web")
+		}
+	}
+
+	ts := newTailscale([]string{"example.com"})
+	builds := []struct {
+		name     string
+		expected int
+	}{
+		{name: "first build", expected: 1},
+		{name: "unchanged problem", expected: 0},
+		{name: "fixed problem", expected: 0},
+		{name: "reappearing problem", expected: 1},
+	}
+
+	for _, b := range builds {
+		buf.Reset()
+		if b.name == "fixed problem" {
+			ts.buildRecords(testStatus())
+		} else {
+			ts.buildRecords(malformed)
+		}
+		if got := strings.Count(buf.String(), "ignoring malformed service tag"); got != b.expected {
+			t.Errorf("%s: expected %d warnings but got %d", b.name, b.expected, got)
+		}
+	}
+}
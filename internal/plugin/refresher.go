@@ -0,0 +1,180 @@
+package plugin
+
+import (
+	"context"
+	"errors"
+	"slices"
+	"sync"
+	"time"
+
+	clog "github.com/coredns/coredns/plugin/pkg/log"
+	"tailscale.com/client/tailscale"
+)
+
+// refresher reads the status of one tailscaled and hands it to every plugin
+// instance using that tailscaled. Server blocks with the same socket share a
+// refresher, so tailscaled is polled and watched once per process.
+type refresher struct {
+	socket  string
+	lc      *tailscale.LocalClient
+	changed chan struct{} // signaled when tailscaled reports a netmap change
+	cancel  context.CancelFunc
+	wg      sync.WaitGroup
+
+	refreshMu sync.Mutex // serializes refreshes
+
+	mu   sync.Mutex
+	subs []*Tailscale
+}
+
+var (
+	refreshersMu sync.Mutex
+	refreshers   = make(map[string]*refresher) // socket path -> running refresher
+)
+
+// subscribe adds t to the refresher of its socket, starting the refresher when
+// t is the first instance using the socket.
+func subscribe(t *Tailscale) *refresher {
+	refreshersMu.Lock()
+	defer refreshersMu.Unlock()
+
+	r, ok := refreshers[t.lc.Socket]
+	if !ok {
+		r = &refresher{
+			socket:  t.lc.Socket,
+			lc:      &tailscale.LocalClient{Socket: t.lc.Socket},
+			changed: make(chan struct{}, 1),
+		}
+		refreshers[r.socket] = r
+	}
+
+	r.mu.Lock()
+	r.subs = append(r.subs, t)
+	r.mu.Unlock()
+
+	if !ok {
+		r.start()
+	}
+	return r
+}
+
+// unsubscribe removes t from the refresher and stops the refresher when no
+// instance uses it anymore.
+func (r *refresher) unsubscribe(t *Tailscale) {
+	refreshersMu.Lock()
+	r.mu.Lock()
+	r.subs = slices.DeleteFunc(r.subs, func(s *Tailscale) bool { return s == t })
+	last := len(r.subs) == 0
+	r.mu.Unlock()
+	if last {
+		delete(refreshers, r.socket)
+	}
+	refreshersMu.Unlock()
+
+	if last {
+		r.cancel()
+		r.wg.Wait()
+		clog.Infof("stopped refreshing records from %s", r.socket)
+	}
+}
+
+// start launches the refresh loop and the notification watch.
+func (r *refresher) start() {
+	ctx, cancel := context.WithCancel(context.Background())
+	r.cancel = cancel
+
+	r.wg.Add(2)
+	go func() {
+		defer r.wg.Done()
+		r.run(ctx)
+	}()
+	go func() {
+		defer r.wg.Done()
+		r.watchIPNBus(ctx)
+	}()
+}
+
+// subscribers returns the instances currently using the refresher.
+func (r *refresher) subscribers() []*Tailscale {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return slices.Clone(r.subs)
+}
+
+// interval returns the shortest refresh interval of the subscribers, or the
+// default interval when there are none.
+func (r *refresher) interval() time.Duration {
+	subs := r.subscribers()
+	if len(subs) == 0 {
+		return getRefreshInterval()
+	}
+	interval := subs[0].refreshInterval
+	for _, t := range subs[1:] {
+		interval = min(interval, t.refreshInterval)
+	}
+	return interval
+}
+
+// requestRefresh asks the refresh loop for a refresh. Requests are coalesced
+// while one is pending.
+func (r *refresher) requestRefresh() {
+	select {
+	case r.changed <- struct{}{}:
+	default:
+	}
+}
+
+// run updates the subscribers periodically and whenever a refresh is
+// requested, until ctx is done. All refreshes run in this goroutine.
+func (r *refresher) run(ctx context.Context) {
+	for {
+		timer := time.NewTimer(r.interval())
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return
+		case <-timer.C:
+		case <-r.changed:
+			timer.Stop()
+			// Let a burst of changes settle before reading the status
+			select {
+			case <-ctx.Done():
+				return
+			case <-time.After(changeSettleDelay):
+			}
+			select {
+			case <-r.changed:
+			default:
+			}
+		}
+		r.refresh(ctx)
+	}
+}
+
+// refresh fetches the current Tailscale status and updates every subscriber.
+func (r *refresher) refresh(ctx context.Context) {
+	r.refreshMu.Lock()
+	defer r.refreshMu.Unlock()
+
+	start := time.Now()
+	status, err := r.lc.Status(ctx)
+	if err != nil {
+		if !errors.Is(ctx.Err(), context.Canceled) {
+			clog.Errorf("failed to get Tailscale status: %v", err)
+			refreshErrors.Inc()
+		}
+		return
+	}
+	if status == nil || status.Self == nil {
+		clog.Warning("received nil status or self node from Tailscale")
+		refreshErrors.Inc()
+		return
+	}
+
+	for _, t := range r.subscribers() {
+		t.update(status)
+	}
+
+	refreshDuration.Observe(time.Since(start).Seconds())
+	lastRefreshSuccess.Store(time.Now().UnixNano())
+}
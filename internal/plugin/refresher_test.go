@@ -0,0 +1,76 @@
+package plugin
+
+import (
+	"bytes"
+	golog "log"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestRefresherLifecycle(t *testing.T) {
+	socket := filepath.Join(t.TempDir(), "tailscaled.sock")
+
+	first := newTailscale([]string{"example.com"})
+	first.lc.Socket = socket
+	second := newTailscale([]string{"example.org"})
+	second.lc.Socket = socket
+	second.refreshInterval = 5 * time.Second
+	other := newTailscale([]string{"example.net"})
+	other.lc.Socket = filepath.Join(t.TempDir(), "other.sock")
+
+	for _, ts := range []*Tailscale{first, second, other} {
+		if err := ts.OnStartup(); err != nil {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+	}
+
+	if first.refresher != second.refresher {
+		t.Errorf("Expected instances with the same socket to share a refresher")
+	}
+	if first.refresher == other.refresher {
+		t.Errorf("Expected instances with different sockets to use different refreshers")
+	}
+	if interval := first.refresher.interval(); interval != 5*time.Second {
+		t.Errorf("Expected the shortest refresh interval 5s but got %s", interval)
+	}
+
+	// The shared refresher keeps running until its last instance shuts down.
+	if err := first.OnShutdown(); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if refresher := refreshers[socket]; refresher == nil || refresher != second.refresher {
+		t.Errorf("Expected the shared refresher to keep running")
+	}
+
+	for _, ts := range []*Tailscale{second, other} {
+		if err := ts.OnShutdown(); err != nil {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+	}
+	if len(refreshers) != 0 {
+		t.Errorf("Expected no running refreshers but got %d", len(refreshers))
+	}
+}
+
+func TestRefresherIntervalWarning(t *testing.T) {
+	var buf bytes.Buffer
+	golog.SetOutput(&buf)
+	defer golog.SetOutput(os.Stderr)
+
+	t.Setenv("TSC_REFRESH_INTERVAL", "soon")
+	ts := newTailscale([]string{"example.com"})
+	r := &refresher{subs: []*Tailscale{ts}}
+
+	buf.Reset()
+	for i := 0; i < 3; i++ {
+		if interval := r.interval(); interval != 30*time.Second {
+			t.Errorf("Expected the default refresh interval 30s but got %s", interval)
+		}
+	}
+	if got := strings.Count(buf.String(), "invalid TSC_REFRESH_INTERVAL"); got != 0 {
+		t.Errorf("Expected no warnings while instances are subscribed but got %d", got)
+	}
+}
@@ -2,11 +2,17 @@ package plugin
 
 import (
 	"context"
+	"math/rand/v2"
+	"net/netip"
 	"strings"
+	"time"
 
 	"github.com/coredns/coredns/plugin"
+	"github.com/coredns/coredns/plugin/metrics"
+	"github.com/coredns/coredns/plugin/pkg/dnsutil"
 	"github.com/coredns/coredns/request"
 	"github.com/miekg/dns"
+	"tailscale.com/net/tsaddr"
 )
 
 // ServeDNS handles DNS requests for the Tailscale domains.
@@ -14,23 +20,254 @@ func (t *Tailscale) ServeDNS(ctx context.Context, w dns.ResponseWriter, r *dns.M
 	state := request.Request{W: w, Req: r}
 	queryName := state.Name()
 
-	// Check if query is for any of our Tailscale domains
-	matchesDomain := false
-	for _, domain := range t.Domains {
-		if strings.HasSuffix(queryName, domain+".") {
-			matchesDomain = true
-			break
-		}
+	if state.QType() == dns.TypeDNSKEY && t.dnssec != nil && len(t.dnssec.keys[queryName]) > 0 {
+		return t.serveDNSKEY(ctx, w, r, state)
+	}
+
+	if zone := t.dnssec.reverseZone(queryName); zone != "" {
+		return t.serveReverseZone(ctx, w, r, state, zone)
 	}
 
-	if !matchesDomain {
+	if state.QType() == dns.TypePTR && isTailnetReverse(queryName) {
+		return t.servePTR(ctx, w, r, state)
+	}
+
+	zone := plugin.Zones(t.zones).Matches(queryName)
+	if zone == "" {
 		return plugin.NextOrFailure(t.Name(), t.Next, ctx, w, r)
 	}
 
-	t.mu.RLock()
-	rec, ok := t.records[queryName]
-	t.mu.RUnlock()
+	table, serial, ttl := t.current()
+	v := t.viewFor(ctx, state)
+
+	rec := v.filter(table, table.Records[queryName])
+	group, isGroup := table.Groups[queryName]
+	group = v.filter(table, group)
+	_, isAlias := table.Aliases[queryName]
+	services := v.services(table, table.Services[queryName])
+	exists := queryName == zone || table.exists(queryName, v)
+
+	// Names of nodes hidden from the querier do not exist for it
+	if !table.visible(queryName, v) {
+		isGroup, isAlias = false, false
+	}
+
+	m := new(dns.Msg)
+	m.SetReply(r)
+	m.Authoritative = true
+
+	header := dns.RR_Header{Name: queryName, Rrtype: state.QType(), Class: state.QClass(), Ttl: ttl}
+
+	switch state.QType() {
+	case dns.TypeA, dns.TypeAAAA:
+		switch {
+		case isAlias:
+			m.Answer = table.resolveAlias(queryName, state.QType(), ttl, v)
+		case isGroup:
+			// Shuffle the members of a service group for round-robin load balancing
+			m.Answer = addressAnswers(queryName, group, state.QType(), ttl)
+			rand.Shuffle(len(m.Answer), func(i, j int) { m.Answer[i], m.Answer[j] = m.Answer[j], m.Answer[i] })
+		default:
+			m.Answer = addressAnswers(queryName, rec, state.QType(), ttl)
+		}
+	case dns.TypeSRV:
+		seen := make(map[string]bool)
+		for _, srv := range services {
+			m.Answer = append(m.Answer, &dns.SRV{Hdr: header, Priority: 10, Weight: 10, Port: srv.Port, Target: srv.Target})
+			if !seen[srv.Target] {
+				seen[srv.Target] = true
+				m.Extra = append(m.Extra, addressRRs(srv.Target, v.filter(table, table.Records[srv.Target]), ttl)...)
+			}
+		}
+	case dns.TypeSOA:
+		if queryName == zone {
+			m.Answer = append(m.Answer, t.soa(zone, table, serial, ttl))
+		}
+	case dns.TypeNS:
+		if queryName == zone {
+			for _, ns := range table.NS[zone] {
+				m.Answer = append(m.Answer, &dns.NS{Hdr: header, Ns: ns})
+				m.Extra = append(m.Extra, addressRRs(ns, v.filter(table, table.Records[ns]), ttl)...)
+			}
+		}
+	}
+
+	// An alias answers every other type with its CNAME
+	if isAlias && len(m.Answer) == 0 {
+		m.Answer = table.resolveAlias(queryName, dns.TypeCNAME, ttl, v)
+	}
+
+	// Unknown names and missing types are answered authoritatively with
+	// NXDOMAIN or NODATA, unless fallthrough is enabled for the name.
+	if len(m.Answer) == 0 {
+		if t.fall.Through(queryName) {
+			queryCount.WithLabelValues(metrics.WithServer(ctx), state.Type(), resultFallthrough).Inc()
+			return plugin.NextOrFailure(t.Name(), t.Next, ctx, w, r)
+		}
+		if !exists {
+			m.Rcode = dns.RcodeNameError
+		}
+		m.Ns = []dns.RR{t.soa(zone, table, serial, ttl)}
+		if t.dnssec != nil && state.Do() {
+			m.Ns = append(m.Ns, t.dnssec.denial(table, zone, queryName, !exists, ttl, v)...)
+		}
+	}
+
+	if t.dnssec != nil && state.Do() {
+		t.dnssec.sign(m, time.Now())
+	}
+
+	queryCount.WithLabelValues(metrics.WithServer(ctx), state.Type(), resultAnswered).Inc()
+	if err := w.WriteMsg(m); err != nil {
+		return dns.RcodeServerFailure, err
+	}
+	return dns.RcodeSuccess, nil
+}
+
+// exists reports whether name, or a name below it, holds records that the
+// view includes. Names of hidden nodes do not exist, not even as empty
+// non-terminals.
+func (rt *recordTable) exists(name string, v *view) bool {
+	return rt.visible(name, v) || rt.hasDescendant(name, v)
+}
+
+// visible reports whether name holds records that the view includes.
+func (rt *recordTable) visible(name string, v *view) bool {
+	if _, ok := rt.Aliases[name]; ok {
+		return v.allowsAlias(rt, name)
+	}
+	if targets, ok := rt.Services[name]; ok {
+		return len(v.services(rt, targets)) > 0
+	}
+	if _, ok := rt.PTRs[name]; ok {
+		addr, _ := netip.ParseAddr(dnsutil.ExtractAddressFromReverse(name))
+		return v.allowsAddr(rt, addr)
+	}
+	_, isNode := rt.Records[name]
+	_, isGroup := rt.Groups[name]
+	return (isNode || isGroup) && v.allowsName(rt, name)
+}
+
+// hasDescendant reports whether any name below name holds records that the
+// view includes, making name an empty non-terminal.
+func (rt *recordTable) hasDescendant(name string, v *view) bool {
+	suffix := "." + name
+	below := func(fqdn string) bool {
+		return strings.HasSuffix(fqdn, suffix) && rt.visible(fqdn, v)
+	}
+	for fqdn := range rt.Records {
+		if below(fqdn) {
+			return true
+		}
+	}
+	for fqdn := range rt.Groups {
+		if below(fqdn) {
+			return true
+		}
+	}
+	for fqdn := range rt.Aliases {
+		if below(fqdn) {
+			return true
+		}
+	}
+	for fqdn := range rt.Services {
+		if below(fqdn) {
+			return true
+		}
+	}
+	for fqdn := range rt.PTRs {
+		if below(fqdn) {
+			return true
+		}
+	}
+	return false
+}
+
+// maxAliasChain limits how many aliases are followed for a single answer.
+const maxAliasChain = 8
+
+// resolveAlias returns the CNAME chain starting at name, followed by the
+// addresses of the final target when qtype is A or AAAA and the target is a
+// node of the table. Targets outside the table are left to the resolver.
+// Addresses of nodes outside the querier's view are left out.
+func (rt *recordTable) resolveAlias(name string, qtype uint16, ttl uint32, v *view) []dns.RR {
+	var rrs []dns.RR
+	for i := 0; i < maxAliasChain; i++ {
+		target, ok := rt.Aliases[name]
+		if !ok {
+			break
+		}
+		rrs = append(rrs, &dns.CNAME{
+			Hdr:    dns.RR_Header{Name: name, Rrtype: dns.TypeCNAME, Class: dns.ClassINET, Ttl: ttl},
+			Target: target,
+		})
+		name = target
+		if qtype == dns.TypeCNAME {
+			return rrs
+		}
+	}
+
+	rec, ok := rt.Records[name]
 	if !ok {
+		rec = rt.Groups[name]
+	}
+	return append(rrs, addressAnswers(name, v.filter(rt, rec), qtype, ttl)...)
+}
+
+// soa returns the synthesized SOA record of zone. The primary name server is
+// the first NS of the zone.
+func (t *Tailscale) soa(zone string, table *recordTable, serial, ttl uint32) *dns.SOA {
+	mname := "ns.dns." + zone
+	if ns := table.NS[zone]; len(ns) > 0 {
+		mname = ns[0]
+	}
+
+	return &dns.SOA{
+		Hdr:     dns.RR_Header{Name: zone, Rrtype: dns.TypeSOA, Class: dns.ClassINET, Ttl: ttl},
+		Ns:      mname,
+		Mbox:    "hostmaster." + zone,
+		Serial:  serial,
+		Refresh: 7200,
+		Retry:   1800,
+		Expire:  86400,
+		Minttl:  ttl,
+	}
+}
+
+// addressAnswers returns the records of rec matching qtype, which must be A or AAAA.
+func addressAnswers(name string, rec record, qtype uint16, ttl uint32) []dns.RR {
+	var rrs []dns.RR
+	for _, rr := range addressRRs(name, rec, ttl) {
+		if rr.Header().Rrtype == qtype {
+			rrs = append(rrs, rr)
+		}
+	}
+	return rrs
+}
+
+// addressRRs returns the A and AAAA records of name, in the record's family order.
+func addressRRs(name string, rec record, ttl uint32) []dns.RR {
+	var rrs []dns.RR
+	for _, ip := range rec.Addrs {
+		if ip.Is4() {
+			rrs = append(rrs, &dns.A{Hdr: dns.RR_Header{Name: name, Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: ttl}, A: ip.AsSlice()})
+		} else {
+			rrs = append(rrs, &dns.AAAA{Hdr: dns.RR_Header{Name: name, Rrtype: dns.TypeAAAA, Class: dns.ClassINET, Ttl: ttl}, AAAA: ip.AsSlice()})
+		}
+	}
+	return rrs
+}
+
+// servePTR answers reverse lookups for tailnet addresses with the names of the
+// owning node. Addresses of nodes hidden from the querier do not exist and are
+// answered with NXDOMAIN and the SOA of their tailnet reverse zone.
+func (t *Tailscale) servePTR(ctx context.Context, w dns.ResponseWriter, r *dns.Msg, state request.Request) (int, error) {
+	queryName := state.Name()
+
+	table, serial, ttl := t.current()
+	targets := table.PTRs[queryName]
+	if len(targets) == 0 {
+		queryCount.WithLabelValues(metrics.WithServer(ctx), state.Type(), resultFallthrough).Inc()
 		return plugin.NextOrFailure(t.Name(), t.Next, ctx, w, r)
 	}
 
@@ -38,25 +275,115 @@ func (t *Tailscale) ServeDNS(ctx context.Context, w dns.ResponseWriter, r *dns.M
 	m.SetReply(r)
 	m.Authoritative = true
 
-	header := dns.RR_Header{Name: queryName, Rrtype: state.QType(), Class: state.QClass(), Ttl: 60}
+	header := dns.RR_Header{Name: queryName, Rrtype: dns.TypePTR, Class: state.QClass(), Ttl: ttl}
+	addr, _ := netip.ParseAddr(dnsutil.ExtractAddressFromReverse(queryName))
+	if t.viewFor(ctx, state).allowsAddr(table, addr) {
+		for _, target := range targets {
+			m.Answer = append(m.Answer, &dns.PTR{Hdr: header, Ptr: target})
+		}
+	} else {
+		m.Rcode = dns.RcodeNameError
+		soa := t.soa(tailnetReverseZone(addr), table, serial, ttl)
+		if ns := table.NS[t.zones[0]]; len(ns) > 0 {
+			soa.Ns = ns[0]
+		}
+		m.Ns = []dns.RR{soa}
+	}
 
+	if t.dnssec != nil && state.Do() {
+		t.dnssec.sign(m, time.Now())
+	}
+
+	queryCount.WithLabelValues(metrics.WithServer(ctx), state.Type(), resultAnswered).Inc()
+	if err := w.WriteMsg(m); err != nil {
+		return dns.RcodeServerFailure, err
+	}
+	return dns.RcodeSuccess, nil
+}
+
+// serveReverseZone answers queries in a reverse zone the plugin holds keys for.
+// Unlike other reverse lookups, these are answered authoritatively: the zone
+// has SOA and NS records at its apex, and missing addresses are answered with
+// NXDOMAIN and signed denials instead of being passed to the next plugin.
+func (t *Tailscale) serveReverseZone(ctx context.Context, w dns.ResponseWriter, r *dns.Msg, state request.Request, zone string) (int, error) {
+	queryName := state.Name()
+
+	table, serial, ttl := t.current()
+	v := t.viewFor(ctx, state)
+	exists := queryName == zone || table.exists(queryName, v)
+
+	m := new(dns.Msg)
+	m.SetReply(r)
+	m.Authoritative = true
+
+	header := dns.RR_Header{Name: queryName, Rrtype: state.QType(), Class: state.QClass(), Ttl: ttl}
 	switch state.QType() {
-	case dns.TypeA:
-		if rec.IPv4 == nil {
-			return plugin.NextOrFailure(t.Name(), t.Next, ctx, w, r)
+	case dns.TypePTR:
+		if table.visible(queryName, v) {
+			for _, target := range table.PTRs[queryName] {
+				m.Answer = append(m.Answer, &dns.PTR{Hdr: header, Ptr: target})
+			}
+		}
+	case dns.TypeSOA:
+		if queryName == zone {
+			m.Answer = append(m.Answer, t.soa(zone, table, serial, ttl))
 		}
-		m.Answer = append(m.Answer, &dns.A{Hdr: header, A: rec.IPv4})
-	case dns.TypeAAAA:
-		if rec.IPv6 == nil {
+	case dns.TypeNS:
+		if queryName == zone {
+			for _, ns := range table.NS[zone] {
+				m.Answer = append(m.Answer, &dns.NS{Hdr: header, Ns: ns})
+				m.Extra = append(m.Extra, addressRRs(ns, v.filter(table, table.Records[ns]), ttl)...)
+			}
+		}
+	}
+
+	if len(m.Answer) == 0 {
+		if t.fall.Through(queryName) {
+			queryCount.WithLabelValues(metrics.WithServer(ctx), state.Type(), resultFallthrough).Inc()
 			return plugin.NextOrFailure(t.Name(), t.Next, ctx, w, r)
 		}
-		m.Answer = append(m.Answer, &dns.AAAA{Hdr: header, AAAA: rec.IPv6})
-	default:
-		return plugin.NextOrFailure(t.Name(), t.Next, ctx, w, r)
+		if !exists {
+			m.Rcode = dns.RcodeNameError
+		}
+		m.Ns = []dns.RR{t.soa(zone, table, serial, ttl)}
+		if state.Do() {
+			m.Ns = append(m.Ns, t.dnssec.denial(table, zone, queryName, !exists, ttl, v)...)
+		}
 	}
 
+	if state.Do() {
+		t.dnssec.sign(m, time.Now())
+	}
+
+	queryCount.WithLabelValues(metrics.WithServer(ctx), state.Type(), resultAnswered).Inc()
 	if err := w.WriteMsg(m); err != nil {
 		return dns.RcodeServerFailure, err
 	}
 	return dns.RcodeSuccess, nil
-}
\ No newline at end of file
+}
+
+// tailnetReverseZone returns the reverse zone of the tailnet range holding
+// addr, cut to whole labels: 100.in-addr.arpa. for IPv4 and the zone of the
+// /48 ULA range for IPv6.
+func tailnetReverseZone(addr netip.Addr) string {
+	tailnet, labelBits := tsaddr.CGNATRange(), 8
+	if addr.Is6() {
+		tailnet, labelBits = tsaddr.TailscaleULARange(), 4
+	}
+	reverse, _ := dns.ReverseAddr(addr.String())
+	drop := (addr.BitLen() - tailnet.Bits()/labelBits*labelBits) / labelBits
+	return reverse[dns.Split(reverse)[drop]:]
+}
+
+// isTailnetReverse reports whether name is a reverse lookup for a tailnet address.
+func isTailnetReverse(name string) bool {
+	addr := dnsutil.ExtractAddressFromReverse(name)
+	if addr == "" {
+		return false
+	}
+	ip, err := netip.ParseAddr(addr)
+	if err != nil {
+		return false
+	}
+	return isTailnetIP(ip)
+}
@@ -0,0 +1,575 @@
+package plugin
+
+import (
+	"context"
+	"net/netip"
+	"reflect"
+	"sort"
+	"testing"
+
+	"github.com/coredns/coredns/plugin/pkg/dnstest"
+	"github.com/coredns/coredns/plugin/test"
+	"github.com/miekg/dns"
+	"tailscale.com/ipn/ipnstate"
+	"tailscale.com/types/key"
+	"tailscale.com/types/views"
+)
+
+// testStatus returns a Tailscale status with a self node and two peers.
+func testStatus() *ipnstate.Status {
+	return &ipnstate.Status{
+		Self: &ipnstate.PeerStatus{
+			HostName:     "ts-dns",
+			TailscaleIPs: []netip.Addr{netip.MustParseAddr("100.64.0.1"), netip.MustParseAddr("fd7a:115c:a1e0::1")},
+		},
+		Peer: map[key.NodePublic]*ipnstate.PeerStatus{
+			key.NewNode().Public(): {
+				HostName:     "web",
+				TailscaleIPs: []netip.Addr{netip.MustParseAddr("100.64.0.2"), netip.MustParseAddr("fd7a:115c:a1e0::2")},
+				Tags:         tags("tag:cname-app", "tag:srv-http-tcp-8080", "tag:service-frontend"),
+			},
+			key.NewNode().Public(): {
+				HostName:     "db",
+				TailscaleIPs: []netip.Addr{netip.MustParseAddr("100.64.0.3")},
+				Tags:         tags("tag:srv-http-tcp-80", "tag:srv-http-tcp-8080", "tag:srv-postgres-tcp-5432"),
+			},
+			key.NewNode().Public(): {
+				HostName: "vip",
+				Tags:     tags("tag:service-frontend"),
+				TailscaleIPs: []netip.Addr{
+					netip.MustParseAddr("100.64.0.4"),
+					netip.MustParseAddr("fd7a:115c:a1e0::4"),
+					netip.MustParseAddr("100.100.0.4"),
+					netip.MustParseAddr("fd7a:115c:a1e0::5"),
+				},
+			},
+		},
+	}
+}
+
+// tags returns a tag view as found in PeerStatus.Tags.
+func tags(t ...string) *views.Slice[string] {
+	v := views.SliceOf(t)
+	return &v
+}
+
+// newTestTailscale returns a plugin instance whose records are built from status.
+// Options may be set by configure before the records are built.
+func newTestTailscale(domains []string, status *ipnstate.Status, configure func(*Tailscale)) *Tailscale {
+	ts := newTailscale(domains)
+	ts.Next = test.NextHandler(dns.RcodeRefused, nil)
+	if configure != nil {
+		configure(ts)
+	}
+	ts.setTable(ts.buildRecords(status))
+	return ts
+}
+
+func TestServeDNS(t *testing.T) {
+	ts := newTestTailscale([]string{"example.com", "example.org"}, testStatus(), nil)
+
+	tests := []struct {
+		name    string
+		qname   string
+		qtype   uint16
+		rcode   int
+		answers []string
+	}{
+		{
+			name:    "A record",
+			qname:   "web.example.com.",
+			qtype:   dns.TypeA,
+			rcode:   dns.RcodeSuccess,
+			answers: []string{"web.example.com.\t60\tIN\tA\t100.64.0.2"},
+		},
+		{
+			name:    "AAAA record",
+			qname:   "web.example.org.",
+			qtype:   dns.TypeAAAA,
+			rcode:   dns.RcodeSuccess,
+			answers: []string{"web.example.org.\t60\tIN\tAAAA\tfd7a:115c:a1e0::2"},
+		},
+		{
+			name:  "all A records of a node",
+			qname: "vip.example.com.",
+			qtype: dns.TypeA,
+			rcode: dns.RcodeSuccess,
+			answers: []string{
+				"vip.example.com.\t60\tIN\tA\t100.64.0.4",
+				"vip.example.com.\t60\tIN\tA\t100.100.0.4",
+			},
+		},
+		{
+			name:  "all AAAA records of a node",
+			qname: "vip.example.com.",
+			qtype: dns.TypeAAAA,
+			rcode: dns.RcodeSuccess,
+			answers: []string{
+				"vip.example.com.\t60\tIN\tAAAA\tfd7a:115c:a1e0::4",
+				"vip.example.com.\t60\tIN\tAAAA\tfd7a:115c:a1e0::5",
+			},
+		},
+		{
+			name:  "unknown name",
+			qname: "missing.example.com.",
+			qtype: dns.TypeA,
+			rcode: dns.RcodeNameError,
+		},
+		{
+			name:  "missing address family",
+			qname: "db.example.com.",
+			qtype: dns.TypeAAAA,
+			rcode: dns.RcodeSuccess,
+		},
+		{
+			name:  "unsupported type",
+			qname: "web.example.com.",
+			qtype: dns.TypeMX,
+			rcode: dns.RcodeSuccess,
+		},
+		{
+			name:  "name outside the domains falls through",
+			qname: "web.example.net.",
+			qtype: dns.TypeA,
+			rcode: dns.RcodeRefused,
+		},
+		{
+			name:  "domain suffix without label boundary falls through",
+			qname: "webexample.com.",
+			qtype: dns.TypeA,
+			rcode: dns.RcodeRefused,
+		},
+		{
+			name:  "PTR record for IPv4 address",
+			qname: "2.0.64.100.in-addr.arpa.",
+			qtype: dns.TypePTR,
+			rcode: dns.RcodeSuccess,
+			answers: []string{
+				"2.0.64.100.in-addr.arpa.\t60\tIN\tPTR\tweb.example.com.",
+				"2.0.64.100.in-addr.arpa.\t60\tIN\tPTR\tweb.example.org.",
+			},
+		},
+		{
+			name:  "PTR record for IPv6 address",
+			qname: "1.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.e.1.a.c.5.1.1.a.7.d.f.ip6.arpa.",
+			qtype: dns.TypePTR,
+			rcode: dns.RcodeSuccess,
+			answers: []string{
+				"1.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.e.1.a.c.5.1.1.a.7.d.f.ip6.arpa.\t60\tIN\tPTR\tts-dns.example.com.",
+				"1.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.e.1.a.c.5.1.1.a.7.d.f.ip6.arpa.\t60\tIN\tPTR\tts-dns.example.org.",
+			},
+		},
+		{
+			name:  "PTR outside the tailnet falls through",
+			qname: "1.1.168.192.in-addr.arpa.",
+			qtype: dns.TypePTR,
+			rcode: dns.RcodeRefused,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rec := query(t, ts, tt.qname, tt.qtype, tt.rcode)
+			if rec != nil {
+				checkSection(t, "answer", rec.Msg.Answer, tt.answers)
+			}
+		})
+	}
+}
+
+func TestServeDNSFamilies(t *testing.T) {
+	ts := newTestTailscale([]string{"example.com"}, testStatus(), func(ts *Tailscale) {
+		ts.families = []string{familyIPv6}
+	})
+
+	query(t, ts, "vip.example.com.", dns.TypeA, dns.RcodeSuccess)
+	rec := query(t, ts, "vip.example.com.", dns.TypeAAAA, dns.RcodeSuccess)
+	checkSection(t, "answer", rec.Msg.Answer, []string{
+		"vip.example.com.\t60\tIN\tAAAA\tfd7a:115c:a1e0::4",
+		"vip.example.com.\t60\tIN\tAAAA\tfd7a:115c:a1e0::5",
+	})
+	query(t, ts, "4.0.64.100.in-addr.arpa.", dns.TypePTR, dns.RcodeRefused)
+}
+
+func TestServeDNSTTL(t *testing.T) {
+	ts := newTestTailscale([]string{"example.com"}, testStatus(), func(ts *Tailscale) {
+		ts.ttl = 300
+	})
+	ts.serial = 1234
+
+	rec := query(t, ts, "app.example.com.", dns.TypeA, dns.RcodeSuccess)
+	checkSection(t, "answer", rec.Msg.Answer, []string{
+		"app.example.com.\t300\tIN\tCNAME\tweb.example.com.",
+		"web.example.com.\t300\tIN\tA\t100.64.0.2",
+	})
+
+	rec = query(t, ts, "2.0.64.100.in-addr.arpa.", dns.TypePTR, dns.RcodeSuccess)
+	checkSection(t, "answer", rec.Msg.Answer, []string{"2.0.64.100.in-addr.arpa.\t300\tIN\tPTR\tweb.example.com."})
+
+	rec = query(t, ts, "missing.example.com.", dns.TypeA, dns.RcodeNameError)
+	checkSection(t, "authority", rec.Msg.Ns, []string{
+		"example.com.\t300\tIN\tSOA\tts-dns.example.com. hostmaster.example.com. 1234 7200 1800 86400 300",
+	})
+}
+
+func TestServeDNSNegative(t *testing.T) {
+	ts := newTestTailscale([]string{"example.com"}, testStatus(), func(ts *Tailscale) {
+		ts.Domains = append(ts.Domains, "sub.example.com")
+		ts.zones = append(ts.zones, "sub.example.com.")
+	})
+	ts.serial = 1234
+	soa := "example.com.\t60\tIN\tSOA\tts-dns.example.com. hostmaster.example.com. 1234 7200 1800 86400 60"
+
+	tests := []struct {
+		name  string
+		qname string
+		qtype uint16
+		rcode int
+		soa   string
+	}{
+		{
+			name:  "NXDOMAIN carries SOA",
+			qname: "missing.example.com.",
+			qtype: dns.TypeA,
+			rcode: dns.RcodeNameError,
+			soa:   soa,
+		},
+		{
+			name:  "NODATA carries SOA",
+			qname: "db.example.com.",
+			qtype: dns.TypeAAAA,
+			rcode: dns.RcodeSuccess,
+			soa:   soa,
+		},
+		{
+			name:  "apex is NODATA",
+			qname: "example.com.",
+			qtype: dns.TypeA,
+			rcode: dns.RcodeSuccess,
+			soa:   soa,
+		},
+		{
+			name:  "SOA of the most specific zone",
+			qname: "missing.sub.example.com.",
+			qtype: dns.TypeA,
+			rcode: dns.RcodeNameError,
+			soa:   "sub.example.com.\t60\tIN\tSOA\tts-dns.sub.example.com. hostmaster.sub.example.com. 1234 7200 1800 86400 60",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rec := query(t, ts, tt.qname, tt.qtype, tt.rcode)
+			checkSection(t, "answer", rec.Msg.Answer, nil)
+			checkSection(t, "authority", rec.Msg.Ns, []string{tt.soa})
+		})
+	}
+
+	// Names below a node are empty non-terminals when a subdomain tag exists.
+	ts.table.Records["web.team.example.com."] = record{}
+	rec := query(t, ts, "team.example.com.", dns.TypeA, dns.RcodeSuccess)
+	checkSection(t, "authority", rec.Msg.Ns, []string{soa})
+}
+
+func TestServeDNSApex(t *testing.T) {
+	ts := newTestTailscale([]string{"example.com"}, testStatus(), func(ts *Tailscale) {
+		ts.nameservers = map[string][]string{"example.com": {"100.64.0.3", "100.64.0.1", "192.0.2.1"}}
+	})
+	ts.serial = 1234
+
+	rec := query(t, ts, "example.com.", dns.TypeSOA, dns.RcodeSuccess)
+	checkSection(t, "answer", rec.Msg.Answer, []string{
+		"example.com.\t60\tIN\tSOA\tdb.example.com. hostmaster.example.com. 1234 7200 1800 86400 60",
+	})
+
+	rec = query(t, ts, "example.com.", dns.TypeNS, dns.RcodeSuccess)
+	checkSection(t, "answer", rec.Msg.Answer, []string{
+		"example.com.\t60\tIN\tNS\tdb.example.com.",
+		"example.com.\t60\tIN\tNS\tts-dns.example.com.",
+	})
+	checkSection(t, "additional", rec.Msg.Extra, []string{
+		"db.example.com.\t60\tIN\tA\t100.64.0.3",
+		"ts-dns.example.com.\t60\tIN\tA\t100.64.0.1",
+		"ts-dns.example.com.\t60\tIN\tAAAA\tfd7a:115c:a1e0::1",
+	})
+
+	// SOA and NS exist only at the apex.
+	rec = query(t, ts, "web.example.com.", dns.TypeNS, dns.RcodeSuccess)
+	checkSection(t, "answer", rec.Msg.Answer, nil)
+}
+
+func TestSetTableSerial(t *testing.T) {
+	status := testStatus()
+	ts := newTestTailscale([]string{"example.com"}, status, nil)
+	serial := ts.serial
+	if serial == 0 {
+		t.Fatal("Expected a serial after the first table")
+	}
+
+	ts.setTable(ts.buildRecords(status))
+	if ts.serial != serial {
+		t.Errorf("Expected serial %d for an unchanged table but got %d", serial, ts.serial)
+	}
+
+	status.Self.TailscaleIPs = status.Self.TailscaleIPs[:1]
+	ts.setTable(ts.buildRecords(status))
+	if ts.serial <= serial {
+		t.Errorf("Expected serial above %d for a changed table but got %d", serial, ts.serial)
+	}
+}
+
+func TestServeDNSCNAME(t *testing.T) {
+	ts := newTestTailscale([]string{"example.com"}, testStatus(), func(ts *Tailscale) {
+		ts.cnames = []cnameMapping{
+			{Alias: "api.team", Target: "db"},
+			{Alias: "www", Target: "app"},
+			{Alias: "docs.example.com.", Target: "docs.example.net."},
+			{Alias: "other.example.org.", Target: "web"},
+			{Alias: "web", Target: "db"},
+		}
+	})
+
+	tests := []struct {
+		name    string
+		qname   string
+		qtype   uint16
+		answers []string
+	}{
+		{
+			name:  "tag alias",
+			qname: "app.example.com.",
+			qtype: dns.TypeA,
+			answers: []string{
+				"app.example.com.\t60\tIN\tCNAME\tweb.example.com.",
+				"web.example.com.\t60\tIN\tA\t100.64.0.2",
+			},
+		},
+		{
+			name:  "configured alias",
+			qname: "api.team.example.com.",
+			qtype: dns.TypeA,
+			answers: []string{
+				"api.team.example.com.\t60\tIN\tCNAME\tdb.example.com.",
+				"db.example.com.\t60\tIN\tA\t100.64.0.3",
+			},
+		},
+		{
+			name:  "alias chain",
+			qname: "www.example.com.",
+			qtype: dns.TypeAAAA,
+			answers: []string{
+				"www.example.com.\t60\tIN\tCNAME\tapp.example.com.",
+				"app.example.com.\t60\tIN\tCNAME\tweb.example.com.",
+				"web.example.com.\t60\tIN\tAAAA\tfd7a:115c:a1e0::2",
+			},
+		},
+		{
+			name:    "external target",
+			qname:   "docs.example.com.",
+			qtype:   dns.TypeA,
+			answers: []string{"docs.example.com.\t60\tIN\tCNAME\tdocs.example.net."},
+		},
+		{
+			name:    "CNAME query",
+			qname:   "www.example.com.",
+			qtype:   dns.TypeCNAME,
+			answers: []string{"www.example.com.\t60\tIN\tCNAME\tapp.example.com."},
+		},
+		{
+			name:    "other types return the CNAME",
+			qname:   "app.example.com.",
+			qtype:   dns.TypeMX,
+			answers: []string{"app.example.com.\t60\tIN\tCNAME\tweb.example.com."},
+		},
+		{
+			name:    "node names are not replaced by aliases",
+			qname:   "web.example.com.",
+			qtype:   dns.TypeA,
+			answers: []string{"web.example.com.\t60\tIN\tA\t100.64.0.2"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rec := query(t, ts, tt.qname, tt.qtype, dns.RcodeSuccess)
+			checkSection(t, "answer", rec.Msg.Answer, tt.answers)
+		})
+	}
+
+	// Aliases are only published in the domain they belong to.
+	query(t, ts, "other.example.org.", dns.TypeA, dns.RcodeRefused)
+	query(t, ts, "team.example.com.", dns.TypeA, dns.RcodeSuccess)
+}
+
+func TestServeDNSSRV(t *testing.T) {
+	ts := newTestTailscale([]string{"example.com"}, testStatus(), nil)
+
+	rec := query(t, ts, "_http._tcp.example.com.", dns.TypeSRV, dns.RcodeSuccess)
+	checkSection(t, "answer", rec.Msg.Answer, []string{
+		"_http._tcp.example.com.\t60\tIN\tSRV\t10 10 80 db.example.com.",
+		"_http._tcp.example.com.\t60\tIN\tSRV\t10 10 8080 db.example.com.",
+		"_http._tcp.example.com.\t60\tIN\tSRV\t10 10 8080 web.example.com.",
+	})
+	checkSection(t, "additional", rec.Msg.Extra, []string{
+		"db.example.com.\t60\tIN\tA\t100.64.0.3",
+		"web.example.com.\t60\tIN\tA\t100.64.0.2",
+		"web.example.com.\t60\tIN\tAAAA\tfd7a:115c:a1e0::2",
+	})
+
+	rec = query(t, ts, "_postgres._tcp.example.com.", dns.TypeSRV, dns.RcodeSuccess)
+	checkSection(t, "answer", rec.Msg.Answer, []string{
+		"_postgres._tcp.example.com.\t60\tIN\tSRV\t10 10 5432 db.example.com.",
+	})
+
+	// Service names and their parents exist without addresses.
+	query(t, ts, "_http._tcp.example.com.", dns.TypeA, dns.RcodeSuccess)
+	query(t, ts, "_tcp.example.com.", dns.TypeSRV, dns.RcodeSuccess)
+	query(t, ts, "_ssh._tcp.example.com.", dns.TypeSRV, dns.RcodeNameError)
+}
+
+func TestServeDNSServiceGroup(t *testing.T) {
+	ts := newTestTailscale([]string{"example.com"}, testStatus(), func(ts *Tailscale) {
+		ts.cnames = []cnameMapping{{Alias: "www", Target: "frontend"}}
+	})
+
+	rec := query(t, ts, "frontend.example.com.", dns.TypeA, dns.RcodeSuccess)
+	sort.Sort(test.RRSet(rec.Msg.Answer))
+	checkSection(t, "answer", rec.Msg.Answer, []string{
+		"frontend.example.com.\t60\tIN\tA\t100.100.0.4",
+		"frontend.example.com.\t60\tIN\tA\t100.64.0.2",
+		"frontend.example.com.\t60\tIN\tA\t100.64.0.4",
+	})
+
+	rec = query(t, ts, "frontend.example.com.", dns.TypeAAAA, dns.RcodeSuccess)
+	sort.Sort(test.RRSet(rec.Msg.Answer))
+	checkSection(t, "answer", rec.Msg.Answer, []string{
+		"frontend.example.com.\t60\tIN\tAAAA\tfd7a:115c:a1e0::2",
+		"frontend.example.com.\t60\tIN\tAAAA\tfd7a:115c:a1e0::4",
+		"frontend.example.com.\t60\tIN\tAAAA\tfd7a:115c:a1e0::5",
+	})
+
+	rec = query(t, ts, "www.example.com.", dns.TypeAAAA, dns.RcodeSuccess)
+	if len(rec.Msg.Answer) != 4 {
+		t.Errorf("Expected CNAME and 3 AAAA records but got %v", rec.Msg.Answer)
+	}
+
+	// Members are ordered independently of the peer map iteration order.
+	if !reflect.DeepEqual(ts.buildRecords(testStatus()).Groups, ts.table.Groups) {
+		t.Error("Expected identical service groups for identical status")
+	}
+}
+
+func TestServeDNSFilter(t *testing.T) {
+	ts := newTestTailscale([]string{"example.com"}, testStatus(), func(ts *Tailscale) {
+		ts.filter.exclude = []selector{{kind: "tag", value: "service-frontend"}}
+	})
+
+	query(t, ts, "web.example.com.", dns.TypeA, dns.RcodeNameError)
+	query(t, ts, "vip.example.com.", dns.TypeA, dns.RcodeNameError)
+	query(t, ts, "frontend.example.com.", dns.TypeA, dns.RcodeNameError)
+	query(t, ts, "2.0.64.100.in-addr.arpa.", dns.TypePTR, dns.RcodeRefused)
+	query(t, ts, "db.example.com.", dns.TypeA, dns.RcodeSuccess)
+}
+
+func TestServeDNSFilterSelf(t *testing.T) {
+	status := testStatus()
+	status.Self.Tags = tags(defaultHiddenTag)
+	ts := newTestTailscale([]string{"example.com"}, status, nil)
+
+	query(t, ts, "ts-dns.example.com.", dns.TypeA, dns.RcodeNameError)
+	query(t, ts, "1.0.64.100.in-addr.arpa.", dns.TypePTR, dns.RcodeRefused)
+	query(t, ts, "web.example.com.", dns.TypeA, dns.RcodeSuccess)
+
+	// The hidden node is not named as the zone's name server
+	rec := query(t, ts, "example.com.", dns.TypeNS, dns.RcodeSuccess)
+	checkSection(t, "answer", rec.Msg.Answer, nil)
+	rec = query(t, ts, "example.com.", dns.TypeSOA, dns.RcodeSuccess)
+	if soa := rec.Msg.Answer[0].(*dns.SOA); soa.Ns != "ns.dns.example.com." {
+		t.Errorf("Expected SOA name server ns.dns.example.com. but got %s", soa.Ns)
+	}
+}
+
+func TestServeDNSDomainSelectors(t *testing.T) {
+	ts := newTestTailscale([]string{"prod.example.com", "dev.example.com"}, testStatus(), func(ts *Tailscale) {
+		ts.domainSelectors = map[string][]selector{
+			"prod.example.com": {{kind: "tag", value: "service-frontend"}},
+		}
+	})
+
+	query(t, ts, "web.prod.example.com.", dns.TypeA, dns.RcodeSuccess)
+	query(t, ts, "db.prod.example.com.", dns.TypeA, dns.RcodeNameError)
+	query(t, ts, "web.dev.example.com.", dns.TypeA, dns.RcodeSuccess)
+	query(t, ts, "db.dev.example.com.", dns.TypeA, dns.RcodeSuccess)
+
+	// The local node is selected like any other node
+	query(t, ts, "ts-dns.prod.example.com.", dns.TypeA, dns.RcodeNameError)
+	query(t, ts, "ts-dns.dev.example.com.", dns.TypeA, dns.RcodeSuccess)
+
+	rec := query(t, ts, "3.0.64.100.in-addr.arpa.", dns.TypePTR, dns.RcodeSuccess)
+	checkSection(t, "answer", rec.Msg.Answer, []string{"3.0.64.100.in-addr.arpa.\t60\tIN\tPTR\tdb.dev.example.com."})
+}
+
+func TestServeDNSFallthrough(t *testing.T) {
+	ts := newTestTailscale([]string{"example.com", "example.org"}, testStatus(), func(ts *Tailscale) {
+		ts.fall.SetZonesFromArgs([]string{"example.org"})
+	})
+
+	query(t, ts, "missing.example.com.", dns.TypeA, dns.RcodeNameError)
+	query(t, ts, "missing.example.org.", dns.TypeA, dns.RcodeRefused)
+	query(t, ts, "db.example.org.", dns.TypeAAAA, dns.RcodeRefused)
+	query(t, ts, "db.example.org.", dns.TypeA, dns.RcodeSuccess)
+}
+
+// query sends a question to ts and checks the rcode of the response. Queries
+// passed to the next plugin are checked against the rcode it returned and
+// yield a nil recorder.
+func query(t *testing.T, ts *Tailscale, qname string, qtype uint16, want int) *dnstest.Recorder {
+	t.Helper()
+
+	req := new(dns.Msg)
+	req.SetQuestion(qname, qtype)
+
+	rec := dnstest.NewRecorder(&test.ResponseWriter{})
+	rcode, err := ts.ServeDNS(context.Background(), rec, req)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if rec.Msg != nil {
+		rcode = rec.Msg.Rcode
+	}
+	if rcode != want {
+		t.Fatalf("Expected rcode %d but got %d", want, rcode)
+	}
+	if rec.Msg == nil {
+		return nil
+	}
+	return rec
+}
+
+// checkSection compares the presentation format of a message section with want.
+func checkSection(t *testing.T, section string, rrs []dns.RR, want []string) {
+	t.Helper()
+
+	if len(rrs) != len(want) {
+		t.Fatalf("Expected %d %s records but got %d: %v", len(want), section, len(rrs), rrs)
+	}
+	for i, rr := range rrs {
+		if rr.String() != want[i] {
+			t.Errorf("Expected %s record %q but got %q", section, want[i], rr.String())
+		}
+	}
+}
+
+func TestTailnetReverseZone(t *testing.T) {
+	tests := map[string]string{
+		"100.64.0.2":        "100.in-addr.arpa.",
+		"100.127.255.1":     "100.in-addr.arpa.",
+		"fd7a:115c:a1e0::2": "0.e.1.a.c.5.1.1.a.7.d.f.ip6.arpa.",
+	}
+
+	for addr, expected := range tests {
+		if zone := tailnetReverseZone(netip.MustParseAddr(addr)); zone != expected {
+			t.Errorf("Expected reverse zone %s for %s but got %s", expected, addr, zone)
+		}
+	}
+}
@@ -1,12 +1,21 @@
 package plugin
 
 import (
+	"fmt"
+	"net/netip"
+	"slices"
+	"strconv"
 	"strings"
+	"time"
 
 	"github.com/coredns/caddy"
 	"github.com/coredns/coredns/core/dnsserver"
 	"github.com/coredns/coredns/plugin"
 	clog "github.com/coredns/coredns/plugin/pkg/log"
+	"github.com/coredns/coredns/plugin/transfer"
+	"github.com/miekg/dns"
+	"tailscale.com/net/tsaddr"
+	"tailscale.com/tailcfg"
 )
 
 var log = clog.NewWithPlugin("tailscale")
@@ -18,40 +27,458 @@ func init() {
 
 // setup configures the Tailscale plugin with the given domains.
 func setup(c *caddy.Controller) error {
+	ts, err := parse(c)
+	if err != nil {
+		return plugin.Error("tailscale", err)
+	}
+
+	ts.initialize()
+	if err := ts.initializePolicy(); err != nil {
+		return plugin.Error("tailscale", err)
+	}
+	if ts.dnssec != nil {
+		ts.dnssec.logDS()
+	}
+
+	// Secondaries configured in the transfer plugin are notified of changes
+	c.OnStartup(func() error {
+		if t := dnsserver.GetConfig(c).Handler("transfer"); t != nil {
+			ts.notifier = t.(*transfer.Transfer)
+		}
+		return nil
+	})
+	// Answers that depend on the querier must not be shared through a cache
+	c.OnStartup(func() error {
+		if ts.aclEnabled() && dnsserver.GetConfig(c).Handler("cache") != nil {
+			log.Warning("the cache plugin in this server block answers every querier with the answers cached for another; remove it to keep acl answers per querier")
+		}
+		return nil
+	})
+	c.OnStartup(ts.OnStartup)
+	c.OnShutdown(ts.OnShutdown)
+
+	dnsserver.GetConfig(c).AddPlugin(func(next plugin.Handler) plugin.Handler {
+		ts.Next = next
+		return ts
+	})
+
+	return nil
+}
+
+// parse reads the tailscale directive and its optional block:
+//
+//	tailscale example.com [example.org...] {
+//	    ttl SECONDS
+//	    refresh DURATION
+//	    socket PATH
+//	    staleness DURATION
+//	    snapshot PATH [TTL]
+//	    families ipv4 ipv6
+//	    fallthrough [zones...]
+//	    cname ALIAS TARGET
+//	    online_only
+//	    max_last_seen DURATION
+//	    exclude_expired
+//	    include SELECTOR...
+//	    exclude SELECTOR...
+//	    hidden_tag TAG
+//	    select DOMAIN SELECTOR...
+//	    name_template DOMAIN|. TEMPLATE...
+//	    subdomain_tag_prefix PREFIX
+//	    owner_names
+//	    name_source hostname|dnsname|both
+//	    dnssec KEY...
+//	    dnssec_denial nsec|nsec3
+//	    acl policy|CAPABILITY
+//	    acl_unidentified allow|deny
+//	    lan_tags [PREFIX]
+//	    lan_map PATH
+//	    lan_routes
+//	}
+func parse(c *caddy.Controller) (*Tailscale, error) {
 	var domains []string
 
 	c.Next() // 'tailscale'
-	
+
 	// Parse all domains on the same line
-	for c.NextArg() {
-		domain := c.Val()
+	for _, domain := range c.RemainingArgs() {
 		// Split by comma if multiple domains are provided together
 		if strings.Contains(domain, ",") {
 			parts := strings.Split(domain, ",")
 			for _, part := range parts {
 				trimmed := strings.TrimSpace(part)
 				if trimmed != "" {
-					domains = append(domains, trimmed)
+					domains = append(domains, normalizeDomain(trimmed))
 				}
 			}
 		} else {
-			domains = append(domains, domain)
+			domains = append(domains, normalizeDomain(domain))
 		}
 	}
 
 	if len(domains) == 0 {
-		return c.ArgErr()
+		return nil, c.ArgErr()
 	}
 
-	ts, err := New(domains)
-	if err != nil {
-		return plugin.Error("tailscale", err)
+	ts := newTailscale(domains)
+	stalenessSet := false
+
+	for c.NextBlock() {
+		switch c.Val() {
+		case "ttl":
+			args := c.RemainingArgs()
+			if len(args) != 1 {
+				return nil, c.ArgErr()
+			}
+			ttl, err := strconv.ParseUint(args[0], 10, 32)
+			if err != nil || ttl == 0 || ttl > 65535 {
+				return nil, c.Errf("ttl must be a number of seconds between 1 and 65535, got '%s'", args[0])
+			}
+			ts.ttl = uint32(ttl)
+		case "refresh":
+			args := c.RemainingArgs()
+			if len(args) != 1 {
+				return nil, c.ArgErr()
+			}
+			interval, err := time.ParseDuration(args[0])
+			if err != nil || interval <= 0 {
+				return nil, c.Errf("refresh must be a positive duration, got '%s'", args[0])
+			}
+			ts.refreshInterval = interval
+		case "staleness":
+			args := c.RemainingArgs()
+			if len(args) != 1 {
+				return nil, c.ArgErr()
+			}
+			staleness, err := time.ParseDuration(args[0])
+			if err != nil || staleness < 0 {
+				return nil, c.Errf("staleness must be a duration, got '%s'", args[0])
+			}
+			ts.staleness = staleness
+			stalenessSet = true
+		case "snapshot":
+			args := c.RemainingArgs()
+			if len(args) < 1 || len(args) > 2 {
+				return nil, c.ArgErr()
+			}
+			ts.snapshotPath = args[0]
+			if len(args) == 2 {
+				ttl, err := strconv.ParseUint(args[1], 10, 32)
+				if err != nil || ttl == 0 || ttl > 65535 {
+					return nil, c.Errf("snapshot ttl must be a number of seconds between 1 and 65535, got '%s'", args[1])
+				}
+				ts.staleTTL = uint32(ttl)
+			}
+		case "socket":
+			args := c.RemainingArgs()
+			if len(args) != 1 {
+				return nil, c.ArgErr()
+			}
+			ts.lc.Socket = args[0]
+		case "families":
+			families, err := parseFamilies(c.RemainingArgs())
+			if err != nil {
+				return nil, c.Errf("%v", err)
+			}
+			ts.families = families
+		case "fallthrough":
+			ts.fall.SetZonesFromArgs(c.RemainingArgs())
+		case "cname":
+			args := c.RemainingArgs()
+			if len(args) != 2 {
+				return nil, c.ArgErr()
+			}
+			ts.cnames = append(ts.cnames, cnameMapping{Alias: args[0], Target: args[1]})
+		case "online_only":
+			if c.NextArg() {
+				return nil, c.ArgErr()
+			}
+			ts.filter.onlineOnly = true
+		case "max_last_seen":
+			if !c.NextArg() {
+				return nil, c.ArgErr()
+			}
+			d, err := time.ParseDuration(c.Val())
+			if err != nil || d <= 0 {
+				return nil, c.Errf("invalid max_last_seen duration '%s'", c.Val())
+			}
+			ts.filter.maxLastSeen = d
+			if c.NextArg() {
+				return nil, c.ArgErr()
+			}
+		case "exclude_expired":
+			if c.NextArg() {
+				return nil, c.ArgErr()
+			}
+			ts.filter.excludeExpired = true
+		case "include", "exclude":
+			property := c.Val()
+			selectors, err := parseSelectors(c.RemainingArgs())
+			if err != nil {
+				return nil, c.Errf("%s: %v", property, err)
+			}
+			if property == "include" {
+				ts.filter.include = append(ts.filter.include, selectors...)
+			} else {
+				ts.filter.exclude = append(ts.filter.exclude, selectors...)
+			}
+		case "select":
+			args := c.RemainingArgs()
+			if len(args) < 2 {
+				return nil, c.ArgErr()
+			}
+			domain := normalizeDomain(args[0])
+			if !slices.Contains(ts.Domains, domain) {
+				return nil, c.Errf("select: '%s' is not one of the configured domains", args[0])
+			}
+			selectors, err := parseSelectors(args[1:])
+			if err != nil {
+				return nil, c.Errf("select: %v", err)
+			}
+			if ts.domainSelectors == nil {
+				ts.domainSelectors = make(map[string][]selector)
+			}
+			ts.domainSelectors[domain] = append(ts.domainSelectors[domain], selectors...)
+		case "name_template":
+			args := c.RemainingArgs()
+			if len(args) < 2 {
+				return nil, c.ArgErr()
+			}
+			domains := ts.Domains
+			if args[0] != "." {
+				domain := normalizeDomain(args[0])
+				if !slices.Contains(ts.Domains, domain) {
+					return nil, c.Errf("name_template: '%s' is not one of the configured domains", args[0])
+				}
+				domains = []string{domain}
+			}
+			for _, text := range args[1:] {
+				nt, err := parseNameTemplate(text)
+				if err != nil {
+					return nil, c.Errf("%v", err)
+				}
+				if ts.nameTemplates == nil {
+					ts.nameTemplates = make(map[string][]*nameTemplate)
+				}
+				for _, domain := range domains {
+					ts.nameTemplates[domain] = append(ts.nameTemplates[domain], nt)
+				}
+			}
+		case "subdomain_tag_prefix":
+			args := c.RemainingArgs()
+			if len(args) != 1 || !strings.HasPrefix(args[0], "tag:") {
+				return nil, c.Errf("subdomain_tag_prefix requires a single tag: prefix")
+			}
+			ts.subdomainTagPrefix = args[0]
+		case "name_source":
+			args := c.RemainingArgs()
+			if len(args) != 1 {
+				return nil, c.ArgErr()
+			}
+			switch source := strings.ToLower(args[0]); source {
+			case nameSourceHostName, nameSourceDNSName, nameSourceBoth:
+				ts.nameSource = source
+			default:
+				return nil, c.Errf("unknown name source '%s', expected hostname, dnsname or both", args[0])
+			}
+		case "owner_names":
+			if c.NextArg() {
+				return nil, c.ArgErr()
+			}
+			ts.ownerNames = true
+		case "dnssec":
+			args := c.RemainingArgs()
+			if len(args) == 0 {
+				return nil, c.ArgErr()
+			}
+			if ts.dnssec == nil {
+				ts.dnssec = newZoneSigner()
+			}
+			for _, base := range args {
+				key, err := readSigningKey(base)
+				if err != nil {
+					return nil, c.Errf("dnssec: %v", err)
+				}
+				zone := key.dnskey.Hdr.Name
+				if !slices.Contains(ts.zones, zone) && !isTailnetReverseZone(zone) {
+					return nil, c.Errf("dnssec: key %s is for '%s', which is neither a configured domain nor a reverse zone of tailnet addresses", base, zone)
+				}
+				ts.dnssec.addKey(key)
+			}
+		case "dnssec_denial":
+			args := c.RemainingArgs()
+			if len(args) != 1 {
+				return nil, c.ArgErr()
+			}
+			if ts.dnssec == nil {
+				ts.dnssec = newZoneSigner()
+			}
+			switch denial := strings.ToLower(args[0]); denial {
+			case denialNSEC, denialNSEC3:
+				ts.dnssec.method = denial
+			default:
+				return nil, c.Errf("unknown denial method '%s', expected nsec or nsec3", args[0])
+			}
+		case "acl":
+			args := c.RemainingArgs()
+			switch {
+			case len(args) == 1 && strings.EqualFold(args[0], aclPolicyMode):
+				ts.aclPolicy = true
+			case len(args) == 1 && strings.Contains(args[0], "/"):
+				ts.aclCapability = tailcfg.PeerCapability(args[0])
+			default:
+				return nil, c.Errf("acl requires policy or a single capability name such as example.com/cap/ts-dns")
+			}
+		case "acl_unidentified":
+			args := c.RemainingArgs()
+			if len(args) != 1 {
+				return nil, c.ArgErr()
+			}
+			switch strings.ToLower(args[0]) {
+			case "allow":
+				ts.aclAllowUnidentified = true
+			case "deny":
+				ts.aclAllowUnidentified = false
+			default:
+				return nil, c.Errf("acl_unidentified must be allow or deny, got '%s'", args[0])
+			}
+		case "lan_tags":
+			args := c.RemainingArgs()
+			switch {
+			case len(args) == 0:
+				ts.lan.tagPrefix = defaultLANTagPrefix
+			case len(args) == 1 && strings.HasPrefix(args[0], "tag:"):
+				ts.lan.tagPrefix = args[0]
+			default:
+				return nil, c.Errf("lan_tags takes an optional tag:PREFIX argument")
+			}
+		case "lan_map":
+			args := c.RemainingArgs()
+			if len(args) != 1 {
+				return nil, c.ArgErr()
+			}
+			ts.lan.path = args[0]
+			if err := ts.lan.reload(); err != nil {
+				return nil, c.Errf("lan_map: %v", err)
+			}
+		case "lan_routes":
+			if len(c.RemainingArgs()) != 0 {
+				return nil, c.ArgErr()
+			}
+			ts.lan.routes = true
+		case "hidden_tag":
+			args := c.RemainingArgs()
+			if len(args) != 1 || !strings.HasPrefix(args[0], "tag:") {
+				return nil, c.Errf("hidden_tag requires a single tag:NAME argument")
+			}
+			ts.filter.hiddenTag = args[0]
+		default:
+			return nil, c.Errf("unknown property '%s'", c.Val())
+		}
 	}
 
-	dnsserver.GetConfig(c).AddPlugin(func(next plugin.Handler) plugin.Handler {
-		ts.Next = next
-		return ts
-	})
+	// A window shorter than the time between two polls reports a healthy
+	// plugin not ready; a default window is raised at startup instead
+	if stalenessSet && ts.staleness != 0 && ts.staleness <= ts.refreshInterval {
+		return nil, c.Errf("staleness %s must be longer than the refresh interval %s", ts.staleness, ts.refreshInterval)
+	}
 
-	return nil
-}
\ No newline at end of file
+	if ts.dnssec != nil {
+		if len(ts.dnssec.keys) == 0 {
+			return nil, c.Errf("dnssec_denial requires dnssec keys")
+		}
+		for _, zone := range ts.zones {
+			ts.dnssec.addZone(zone)
+		}
+	}
+
+	return ts, nil
+}
+
+// normalizeDomain lowercases a domain and strips its trailing dot, the form
+// used to build record names.
+func normalizeDomain(domain string) string {
+	return strings.TrimSuffix(strings.ToLower(domain), ".")
+}
+
+// isTailnetReverseZone reports whether zone is a reverse zone holding only
+// tailnet addresses, such as 64.100.in-addr.arpa.
+func isTailnetReverseZone(zone string) bool {
+	prefix, ok := reverseZonePrefix(zone)
+	if !ok {
+		return false
+	}
+	for _, tailnet := range []netip.Prefix{tsaddr.CGNATRange(), tsaddr.TailscaleULARange()} {
+		if prefix.Bits() >= tailnet.Bits() && tailnet.Contains(prefix.Addr()) {
+			return true
+		}
+	}
+	return false
+}
+
+// reverseZonePrefix returns the addresses of a reverse zone below
+// in-addr.arpa. or ip6.arpa.
+func reverseZonePrefix(zone string) (netip.Prefix, bool) {
+	zone = strings.ToLower(zone)
+	var labels []string
+	var bits int
+	var ip []byte
+	switch {
+	case dns.IsSubDomain("in-addr.arpa.", zone):
+		labels = dns.SplitDomainName(strings.TrimSuffix(zone, "in-addr.arpa."))
+		if len(labels) > 4 {
+			return netip.Prefix{}, false
+		}
+		ip = make([]byte, 4)
+		for i := range labels {
+			octet, err := strconv.ParseUint(labels[len(labels)-1-i], 10, 8)
+			if err != nil {
+				return netip.Prefix{}, false
+			}
+			ip[i] = byte(octet)
+		}
+		bits = 8 * len(labels)
+	case dns.IsSubDomain("ip6.arpa.", zone):
+		labels = dns.SplitDomainName(strings.TrimSuffix(zone, "ip6.arpa."))
+		if len(labels) > 32 {
+			return netip.Prefix{}, false
+		}
+		ip = make([]byte, 16)
+		for i := range labels {
+			nibble, err := strconv.ParseUint(labels[len(labels)-1-i], 16, 4)
+			if err != nil || len(labels[len(labels)-1-i]) != 1 {
+				return netip.Prefix{}, false
+			}
+			ip[i/2] |= byte(nibble) << (4 * (1 - i%2))
+		}
+		bits = 4 * len(labels)
+	default:
+		return netip.Prefix{}, false
+	}
+
+	addr, _ := netip.AddrFromSlice(ip)
+	return netip.PrefixFrom(addr, bits), true
+}
+
+// parseFamilies validates the arguments of the families option. The order of
+// the families is kept, duplicates are rejected.
+func parseFamilies(args []string) ([]string, error) {
+	if len(args) == 0 {
+		return nil, fmt.Errorf("families requires at least one of %s, %s", familyIPv4, familyIPv6)
+	}
+
+	var families []string
+	for _, arg := range args {
+		family := strings.ToLower(arg)
+		if family != familyIPv4 && family != familyIPv6 {
+			return nil, fmt.Errorf("invalid address family '%s'", arg)
+		}
+		for _, existing := range families {
+			if existing == family {
+				return nil, fmt.Errorf("duplicate address family '%s'", arg)
+			}
+		}
+		families = append(families, family)
+	}
+	return families, nil
+}
@@ -0,0 +1,459 @@
+package plugin
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/coredns/caddy"
+	"github.com/miekg/dns"
+)
+
+func TestParse(t *testing.T) {
+	tests := []struct {
+		name     string
+		input    string
+		wantErr  bool
+		domains  []string
+		families []string
+	}{
+		{
+			name:     "single domain",
+			input:    `tailscale example.com`,
+			domains:  []string{"example.com"},
+			families: []string{familyIPv4, familyIPv6},
+		},
+		{
+			name:     "comma separated domains",
+			input:    `tailscale example.com,example.org`,
+			domains:  []string{"example.com", "example.org"},
+			families: []string{familyIPv4, familyIPv6},
+		},
+		{
+			name:     "domains are normalized",
+			input:    `tailscale Example.COM. example.org`,
+			domains:  []string{"example.com", "example.org"},
+			families: []string{familyIPv4, familyIPv6},
+		},
+		{
+			name:    "no domains",
+			input:   `tailscale`,
+			wantErr: true,
+		},
+		{
+			name: "families",
+			input: `tailscale example.com {
+				families ipv6 ipv4
+			}`,
+			domains:  []string{"example.com"},
+			families: []string{familyIPv6, familyIPv4},
+		},
+		{
+			name: "restricted family",
+			input: `tailscale example.com {
+				families ipv4
+			}`,
+			domains:  []string{"example.com"},
+			families: []string{familyIPv4},
+		},
+		{
+			name: "invalid family",
+			input: `tailscale example.com {
+				families ipv5
+			}`,
+			wantErr: true,
+		},
+		{
+			name: "duplicate family",
+			input: `tailscale example.com {
+				families ipv4 ipv4
+			}`,
+			wantErr: true,
+		},
+		{
+			name: "unknown property",
+			input: `tailscale example.com {
+				bogus
+			}`,
+			wantErr: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ts, err := parse(caddy.NewTestController("dns", tt.input))
+			if tt.wantErr {
+				if err == nil {
+					t.Fatal("Expected error but got none")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Unexpected error: %v", err)
+			}
+
+			if !reflect.DeepEqual(ts.Domains, tt.domains) {
+				t.Errorf("Expected domains %v but got %v", tt.domains, ts.Domains)
+			}
+			if !reflect.DeepEqual(ts.families, tt.families) {
+				t.Errorf("Expected families %v but got %v", tt.families, ts.families)
+			}
+		})
+	}
+}
+
+func TestParseFallthrough(t *testing.T) {
+	tests := []struct {
+		name    string
+		input   string
+		through map[string]bool
+	}{
+		{
+			name:    "disabled by default",
+			input:   `tailscale example.com example.org`,
+			through: map[string]bool{"a.example.com.": false, "a.example.org.": false},
+		},
+		{
+			name: "all zones",
+			input: `tailscale example.com example.org {
+				fallthrough
+			}`,
+			through: map[string]bool{"a.example.com.": true, "a.example.org.": true},
+		},
+		{
+			name: "selected zones",
+			input: `tailscale example.com example.org {
+				fallthrough example.org
+			}`,
+			through: map[string]bool{"a.example.com.": false, "a.example.org.": true},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ts, err := parse(caddy.NewTestController("dns", tt.input))
+			if err != nil {
+				t.Fatalf("Unexpected error: %v", err)
+			}
+			for qname, want := range tt.through {
+				if got := ts.fall.Through(qname); got != want {
+					t.Errorf("Expected fallthrough for %s to be %t but got %t", qname, want, got)
+				}
+			}
+		})
+	}
+}
+
+func TestParseCNAME(t *testing.T) {
+	input := `tailscale example.com {
+		cname api web
+		cname www.example.com. example.net.
+	}`
+
+	ts, err := parse(caddy.NewTestController("dns", input))
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	expected := []cnameMapping{{Alias: "api", Target: "web"}, {Alias: "www.example.com.", Target: "example.net."}}
+	if !reflect.DeepEqual(ts.cnames, expected) {
+		t.Errorf("Expected cnames %v but got %v", expected, ts.cnames)
+	}
+
+	input = `tailscale example.com {
+		cname api
+	}`
+	if _, err := parse(caddy.NewTestController("dns", input)); err == nil {
+		t.Error("Expected error for cname without target")
+	}
+}
+
+func TestParseFilter(t *testing.T) {
+	input := `tailscale example.com {
+		online_only
+		max_last_seen 168h
+		exclude_expired
+		include tag:web os:linux
+		include user:alice@example.com
+		exclude tag:test
+		hidden_tag tag:private
+	}`
+
+	ts, err := parse(caddy.NewTestController("dns", input))
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	expected := nodeFilter{
+		onlineOnly:     true,
+		maxLastSeen:    168 * time.Hour,
+		excludeExpired: true,
+		include:        []selector{{kind: "tag", value: "web"}, {kind: "os", value: "linux"}, {kind: "user", value: "alice@example.com"}},
+		exclude:        []selector{{kind: "tag", value: "test"}},
+		hiddenTag:      "tag:private",
+	}
+	if !reflect.DeepEqual(ts.filter, expected) {
+		t.Errorf("Expected filter %+v but got %+v", expected, ts.filter)
+	}
+
+	for _, input := range []string{
+		"tailscale example.com {\n online_only yes\n}",
+		"tailscale example.com {\n max_last_seen\n}",
+		"tailscale example.com {\n max_last_seen forever\n}",
+		"tailscale example.com {\n include\n}",
+		"tailscale example.com {\n exclude web\n}",
+		"tailscale example.com {\n hidden_tag private\n}",
+	} {
+		if _, err := parse(caddy.NewTestController("dns", input)); err == nil {
+			t.Errorf("Expected error for %q", input)
+		}
+	}
+}
+
+func TestParseSelect(t *testing.T) {
+	input := `tailscale prod.example.com dev.example.com {
+		select prod.example.com tag:prod
+		select Dev.Example.com. tag:dev os:linux
+	}`
+
+	ts, err := parse(caddy.NewTestController("dns", input))
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	expected := map[string][]selector{
+		"prod.example.com": {{kind: "tag", value: "prod"}},
+		"dev.example.com":  {{kind: "tag", value: "dev"}, {kind: "os", value: "linux"}},
+	}
+	if !reflect.DeepEqual(ts.domainSelectors, expected) {
+		t.Errorf("Expected selectors %v but got %v", expected, ts.domainSelectors)
+	}
+
+	for _, input := range []string{
+		"tailscale example.com {\n select example.com\n}",
+		"tailscale example.com {\n select example.org tag:prod\n}",
+		"tailscale example.com {\n select example.com prod\n}",
+	} {
+		if _, err := parse(caddy.NewTestController("dns", input)); err == nil {
+			t.Errorf("Expected error for %q", input)
+		}
+	}
+}
+
+func TestParseNameTemplates(t *testing.T) {
+	input := `tailscale example.com example.org {
+		name_template . {{.Host}}.{{.Domain}}
+		name_template example.org {{.Host}}.{{.User}}.{{.Domain}}
+		name_template example.com "{{.Host}}.{{dots .Tag}}.{{.Domain}}"
+		subdomain_tag_prefix tag:team-
+		owner_names
+		name_source DNSName
+	}`
+
+	ts, err := parse(caddy.NewTestController("dns", input))
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	expected := map[string][]string{
+		"example.com": {"{{.Host}}.{{.Domain}}", "{{.Host}}.{{dots .Tag}}.{{.Domain}}"},
+		"example.org": {"{{.Host}}.{{.Domain}}", "{{.Host}}.{{.User}}.{{.Domain}}"},
+	}
+	got := make(map[string][]string)
+	for domain, templates := range ts.nameTemplates {
+		for _, nt := range templates {
+			got[domain] = append(got[domain], nt.text)
+		}
+	}
+	if !reflect.DeepEqual(got, expected) {
+		t.Errorf("Expected templates %v but got %v", expected, got)
+	}
+	if ts.subdomainTagPrefix != "tag:team-" {
+		t.Errorf("Expected subdomain tag prefix tag:team- but got %s", ts.subdomainTagPrefix)
+	}
+	if !ts.ownerNames {
+		t.Errorf("Expected owner names to be enabled")
+	}
+	if ts.nameSource != nameSourceDNSName {
+		t.Errorf("Expected name source dnsname but got %s", ts.nameSource)
+	}
+
+	for _, input := range []string{
+		"tailscale example.com {\n name_template .\n}",
+		"tailscale example.com {\n name_template example.org {{.Host}}.{{.Domain}}\n}",
+		"tailscale example.com {\n name_template . {{.Host}}\n}",
+		"tailscale example.com {\n name_template . {{.Host}}.{{dots .Tag}}.{{.Domain}}\n}",
+		"tailscale example.com {\n subdomain_tag_prefix team-\n}",
+		"tailscale example.com {\n owner_names yes\n}",
+		"tailscale example.com {\n name_source\n}",
+		"tailscale example.com {\n name_source machine\n}",
+	} {
+		if _, err := parse(caddy.NewTestController("dns", input)); err == nil {
+			t.Errorf("Expected error for %q", input)
+		}
+	}
+}
+
+func TestParseServerOptions(t *testing.T) {
+	input := `tailscale example.com {
+		ttl 300
+		refresh 5s
+		socket /var/run/tailscale/tailscaled.sock
+		staleness 0s
+		snapshot /state/records.json 5
+	}`
+
+	ts, err := parse(caddy.NewTestController("dns", input))
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	if ts.ttl != 300 {
+		t.Errorf("Expected ttl 300 but got %d", ts.ttl)
+	}
+	if ts.refreshInterval != 5*time.Second {
+		t.Errorf("Expected refresh interval 5s but got %s", ts.refreshInterval)
+	}
+	if ts.lc.Socket != "/var/run/tailscale/tailscaled.sock" {
+		t.Errorf("Expected socket /var/run/tailscale/tailscaled.sock but got %s", ts.lc.Socket)
+	}
+	if ts.staleness != 0 {
+		t.Errorf("Expected staleness 0s but got %s", ts.staleness)
+	}
+	if ts.snapshotPath != "/state/records.json" || ts.staleTTL != 5 {
+		t.Errorf("Expected snapshot /state/records.json with ttl 5 but got %s with ttl %d", ts.snapshotPath, ts.staleTTL)
+	}
+
+	// Defaults apply without a block
+	ts, err = parse(caddy.NewTestController("dns", "tailscale example.com"))
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if ts.ttl != defaultTTL || ts.lc.Socket != defaultSocket {
+		t.Errorf("Expected ttl %d and socket %s but got %d and %s", defaultTTL, defaultSocket, ts.ttl, ts.lc.Socket)
+	}
+
+	for _, input := range []string{
+		"tailscale example.com {\n ttl\n}",
+		"tailscale example.com {\n ttl 0\n}",
+		"tailscale example.com {\n ttl 70000\n}",
+		"tailscale example.com {\n refresh 30\n}",
+		"tailscale example.com {\n refresh -5s\n}",
+		"tailscale example.com {\n socket\n}",
+		"tailscale example.com {\n staleness -1m\n}",
+		"tailscale example.com {\n refresh 10m\n staleness 5m\n}",
+		"tailscale example.com {\n staleness 1m\n refresh 1m\n}",
+		"tailscale example.com {\n snapshot\n}",
+		"tailscale example.com {\n snapshot /state/records.json 0\n}",
+	} {
+		if _, err := parse(caddy.NewTestController("dns", input)); err == nil {
+			t.Errorf("Expected error for %q", input)
+		}
+	}
+}
+
+func TestParseDNSSEC(t *testing.T) {
+	dir := t.TempDir()
+	zoneKey := writeTestKey(t, dir, "example.com.", dns.ZONE)
+	reverseKey := writeTestKey(t, dir, "64.100.in-addr.arpa.", dns.ZONE)
+	wideReverseKey := writeTestKey(t, dir, "100.in-addr.arpa.", dns.ZONE)
+	otherKey := writeTestKey(t, dir, "example.net.", dns.ZONE)
+
+	input := "tailscale example.com example.org {\n dnssec " + zoneKey + " " + reverseKey + "\n dnssec_denial nsec3\n}"
+	ts, err := parse(caddy.NewTestController("dns", input))
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if len(ts.dnssec.keys["example.com."]) != 1 || len(ts.dnssec.keys["64.100.in-addr.arpa."]) != 1 {
+		t.Errorf("Expected keys for example.com. and 64.100.in-addr.arpa. but got %v", ts.dnssec.keys)
+	}
+	if !slices.Equal(ts.dnssec.reverse, []string{"64.100.in-addr.arpa."}) {
+		t.Errorf("Expected signed reverse zone 64.100.in-addr.arpa. but got %v", ts.dnssec.reverse)
+	}
+	if ts.dnssec.method != denialNSEC3 {
+		t.Errorf("Expected denial method nsec3 but got %s", ts.dnssec.method)
+	}
+	if !slices.Contains(ts.dnssec.zones, "example.org.") {
+		t.Errorf("Expected unsigned zone example.org. to be registered but got %v", ts.dnssec.zones)
+	}
+
+	for _, input := range []string{
+		"tailscale example.com {\n dnssec\n}",
+		"tailscale example.com {\n dnssec " + filepath.Join(dir, "missing") + "\n}",
+		"tailscale example.com {\n dnssec " + otherKey + "\n}",
+		"tailscale example.com {\n dnssec " + wideReverseKey + "\n}",
+		"tailscale example.com {\n dnssec " + zoneKey + "\n dnssec_denial nsec5\n}",
+		"tailscale example.com {\n dnssec_denial nsec3\n}",
+	} {
+		if _, err := parse(caddy.NewTestController("dns", input)); err == nil {
+			t.Errorf("Expected error for %q", input)
+		}
+	}
+}
+
+func TestParseACL(t *testing.T) {
+	input := "tailscale example.com {\n acl example.com/cap/ts-dns\n acl_unidentified allow\n}"
+	ts, err := parse(caddy.NewTestController("dns", input))
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if ts.aclCapability != "example.com/cap/ts-dns" || !ts.aclAllowUnidentified {
+		t.Errorf("Expected capability example.com/cap/ts-dns allowing unidentified queriers but got %s, %v", ts.aclCapability, ts.aclAllowUnidentified)
+	}
+
+	ts, err = parse(caddy.NewTestController("dns", "tailscale example.com {\n acl policy\n}"))
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if !ts.aclPolicy || ts.aclCapability != "" {
+		t.Errorf("Expected answers following the tailnet policy but got %v, %q", ts.aclPolicy, ts.aclCapability)
+	}
+
+	for _, input := range []string{
+		"tailscale example.com {\n acl\n}",
+		"tailscale example.com {\n acl ts-dns\n}",
+		"tailscale example.com {\n acl_unidentified maybe\n}",
+	} {
+		if _, err := parse(caddy.NewTestController("dns", input)); err == nil {
+			t.Errorf("Expected error for %q", input)
+		}
+	}
+}
+
+func TestParseLAN(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "lan.hosts")
+	if err := os.WriteFile(path, []byte("web 192.168.1.20\n"), 0o600); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	input := "tailscale example.com {\n lan_tags\n lan_map " + path + "\n lan_routes\n}"
+	ts, err := parse(caddy.NewTestController("dns", input))
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if ts.lan.tagPrefix != defaultLANTagPrefix || !ts.lan.routes || len(ts.lan.hosts["web"]) != 1 {
+		t.Errorf("Expected every LAN source but got %+v", ts.lan)
+	}
+
+	ts, err = parse(caddy.NewTestController("dns", "tailscale example.com {\n lan_tags tag:office-\n}"))
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if ts.lan.tagPrefix != "tag:office-" {
+		t.Errorf("Expected tag prefix tag:office- but got %s", ts.lan.tagPrefix)
+	}
+
+	for _, input := range []string{
+		"tailscale example.com {\n lan_tags office-\n}",
+		"tailscale example.com {\n lan_map\n}",
+		"tailscale example.com {\n lan_map " + filepath.Join(t.TempDir(), "missing") + "\n}",
+		"tailscale example.com {\n lan_routes yes\n}",
+	} {
+		if _, err := parse(caddy.NewTestController("dns", input)); err == nil {
+			t.Errorf("Expected error for %q", input)
+		}
+	}
+}
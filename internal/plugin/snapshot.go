@@ -0,0 +1,85 @@
+package plugin
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"time"
+)
+
+// snapshotVersion is the format version of snapshot files.
+const snapshotVersion = 3
+
+// defaultStaleTTL is the TTL of answers served from a snapshot.
+const defaultStaleTTL = 10
+
+// snapshot is the content of a snapshot file: the last record table built
+// from a Tailscale status, with the serial it was published under.
+type snapshot struct {
+	Version int
+	Domains []string
+	Serial  uint32
+	Table   *recordTable
+}
+
+// loadSnapshot publishes the records of the snapshot file until the first
+// successful refresh. Answers are served with the stale TTL meanwhile.
+func (t *Tailscale) loadSnapshot() error {
+	data, err := os.ReadFile(t.snapshotPath)
+	if err != nil {
+		return err
+	}
+
+	snap := snapshot{Table: newRecordTable()}
+	if err := json.Unmarshal(data, &snap); err != nil {
+		return fmt.Errorf("invalid snapshot %s: %w", t.snapshotPath, err)
+	}
+	if snap.Version != snapshotVersion {
+		return fmt.Errorf("unsupported snapshot version %d in %s", snap.Version, t.snapshotPath)
+	}
+	if !slices.Equal(snap.Domains, t.Domains) {
+		return fmt.Errorf("snapshot %s is for domains %v, not %v", t.snapshotPath, snap.Domains, t.Domains)
+	}
+
+	t.mu.Lock()
+	t.table = snap.Table
+	t.serial = snap.Serial
+	t.stale = true
+	t.updated = time.Now()
+	t.mu.Unlock()
+
+	for _, zone := range t.zones {
+		staleRecords.WithLabelValues(zone).Set(1)
+	}
+	return nil
+}
+
+// saveSnapshot writes the current records to the snapshot file. The file is
+// replaced atomically, so a crash never leaves a partial snapshot behind.
+func (t *Tailscale) saveSnapshot() error {
+	t.mu.RLock()
+	snap := snapshot{Version: snapshotVersion, Domains: t.Domains, Serial: t.serial, Table: t.table}
+	t.mu.RUnlock()
+
+	data, err := json.Marshal(snap)
+	if err != nil {
+		return err
+	}
+
+	tmp, err := os.CreateTemp(filepath.Dir(t.snapshotPath), "."+filepath.Base(t.snapshotPath)+".*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), t.snapshotPath)
+}
@@ -0,0 +1,56 @@
+package plugin
+
+import (
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/miekg/dns"
+)
+
+func TestSnapshot(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "records.json")
+
+	ts := newTestTailscale([]string{"example.com"}, testStatus(), func(ts *Tailscale) {
+		ts.snapshotPath = path
+	})
+	if err := ts.saveSnapshot(); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	loaded := newTailscale([]string{"example.com"})
+	loaded.Next = ts.Next
+	loaded.snapshotPath = path
+	if err := loaded.loadSnapshot(); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	if !reflect.DeepEqual(loaded.table, ts.table) {
+		t.Errorf("Expected the loaded table to equal the saved table")
+	}
+	if loaded.serial != ts.serial {
+		t.Errorf("Expected serial %d but got %d", ts.serial, loaded.serial)
+	}
+	if !loaded.Ready() {
+		t.Errorf("Expected ready while serving a snapshot")
+	}
+
+	// Snapshot records are served with the stale TTL
+	rec := query(t, loaded, "web.example.com.", dns.TypeA, dns.RcodeSuccess)
+	checkSection(t, "answer", rec.Msg.Answer, []string{"web.example.com.\t10\tIN\tA\t100.64.0.2"})
+
+	// A refresh with the same records keeps the serial and restores the TTL
+	serial := loaded.serial
+	loaded.update(testStatus())
+	if loaded.serial != serial {
+		t.Errorf("Expected serial %d after refreshing unchanged records but got %d", serial, loaded.serial)
+	}
+	rec = query(t, loaded, "web.example.com.", dns.TypeA, dns.RcodeSuccess)
+	checkSection(t, "answer", rec.Msg.Answer, []string{"web.example.com.\t60\tIN\tA\t100.64.0.2"})
+
+	other := newTailscale([]string{"example.org"})
+	other.snapshotPath = path
+	if err := other.loadSnapshot(); err == nil {
+		t.Errorf("Expected error loading a snapshot of other domains")
+	}
+}
@@ -102,4 +102,4 @@ func (m *SplitDNSManager) RunWithSignalHandling() error {
 // GetSplitDNSStatus returns the current split DNS status
 func (m *SplitDNSManager) GetSplitDNSStatus() (bool, []string) {
 	return m.ts.enableSplitDNS, m.ts.splitDNSDomains
-}
\ No newline at end of file
+}
@@ -0,0 +1,114 @@
+package plugin
+
+import (
+	"slices"
+
+	"github.com/coredns/coredns/plugin"
+	clog "github.com/coredns/coredns/plugin/pkg/log"
+	"github.com/coredns/coredns/plugin/transfer"
+	"github.com/miekg/dns"
+)
+
+// notifier sends DNS NOTIFY messages for a zone to its secondaries. It is
+// implemented by the transfer plugin, whose "to" hosts receive the messages.
+type notifier interface {
+	Notify(zone string) error
+}
+
+// notify tells the secondaries that the records changed. The zones share one
+// SOA serial, so every zone is announced.
+func (t *Tailscale) notify() {
+	if t.notifier == nil {
+		return
+	}
+	for _, zone := range t.zones {
+		go func() {
+			if err := t.notifier.Notify(zone); err != nil {
+				clog.Warningf("failed to notify secondaries of %s: %v", zone, err)
+			}
+		}()
+	}
+}
+
+// Transfer implements transfer.Transferer. A full transfer sends the SOA, the
+// apex NS records and every record of the zone, followed by the SOA again.
+// Names below another configured domain belong to that domain's zone.
+//
+// The records are rebuilt from the Tailscale status instead of being kept as
+// a history of changes, so an IXFR for an older serial falls back to a full
+// transfer, and one for the current serial gets the SOA only.
+func (t *Tailscale) Transfer(zone string, serial uint32) (<-chan []dns.RR, error) {
+	if !slices.Contains(t.zones, zone) {
+		return nil, transfer.ErrNotAuthoritative
+	}
+
+	table, current, ttl := t.current()
+	soa := t.soa(zone, table, current, ttl)
+
+	ch := make(chan []dns.RR)
+	go func() {
+		defer close(ch)
+
+		if serial != 0 && serial >= current {
+			ch <- []dns.RR{soa}
+			return
+		}
+
+		ch <- []dns.RR{soa}
+		ch <- t.zoneRecords(zone, table, ttl)
+		ch <- []dns.RR{soa}
+	}()
+	return ch, nil
+}
+
+// zoneRecords returns every record of zone except the SOA, ordered by name.
+func (t *Tailscale) zoneRecords(zone string, table *recordTable, ttl uint32) []dns.RR {
+	inZone := func(name string) bool {
+		return plugin.Zones(t.zones).Matches(name) == zone
+	}
+
+	var rrs []dns.RR
+	for _, ns := range table.NS[zone] {
+		rrs = append(rrs, &dns.NS{Hdr: dns.RR_Header{Name: zone, Rrtype: dns.TypeNS, Class: dns.ClassINET, Ttl: ttl}, Ns: ns})
+	}
+
+	var names []string
+	for name := range table.Records {
+		names = append(names, name)
+	}
+	for name := range table.Groups {
+		names = append(names, name)
+	}
+	for name := range table.Aliases {
+		names = append(names, name)
+	}
+	for name := range table.Services {
+		names = append(names, name)
+	}
+	slices.Sort(names)
+
+	for _, name := range names {
+		if !inZone(name) {
+			continue
+		}
+		if rec, ok := table.Records[name]; ok {
+			rrs = append(rrs, addressRRs(name, rec, ttl)...)
+		}
+		if group, ok := table.Groups[name]; ok {
+			rrs = append(rrs, addressRRs(name, group, ttl)...)
+		}
+		if target, ok := table.Aliases[name]; ok {
+			rrs = append(rrs, &dns.CNAME{Hdr: dns.RR_Header{Name: name, Rrtype: dns.TypeCNAME, Class: dns.ClassINET, Ttl: ttl}, Target: target})
+		}
+		for _, srv := range table.Services[name] {
+			rrs = append(rrs, &dns.SRV{
+				Hdr:      dns.RR_Header{Name: name, Rrtype: dns.TypeSRV, Class: dns.ClassINET, Ttl: ttl},
+				Priority: 10,
+				Weight:   10,
+				Port:     srv.Port,
+				Target:   srv.Target,
+			})
+		}
+	}
+	return rrs
+}
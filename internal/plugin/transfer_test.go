@@ -0,0 +1,143 @@
+package plugin
+
+import (
+	"errors"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/coredns/coredns/plugin/transfer"
+	"github.com/miekg/dns"
+)
+
+// collect reads every record sent by a transfer.
+func collect(t *testing.T, ch <-chan []dns.RR, err error) []string {
+	t.Helper()
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	var rrs []string
+	for batch := range ch {
+		for _, rr := range batch {
+			rrs = append(rrs, rr.String())
+		}
+	}
+	return rrs
+}
+
+func TestTransfer(t *testing.T) {
+	ts := newTestTailscale([]string{"example.com", "sub.example.com"}, testStatus(), nil)
+	ts.serial = 1234
+
+	soa := "sub.example.com.\t60\tIN\tSOA\tts-dns.sub.example.com. hostmaster.sub.example.com. 1234 7200 1800 86400 60"
+	expected := []string{
+		soa,
+		"sub.example.com.\t60\tIN\tNS\tts-dns.sub.example.com.",
+		"_http._tcp.sub.example.com.\t60\tIN\tSRV\t10 10 80 db.sub.example.com.",
+		"_http._tcp.sub.example.com.\t60\tIN\tSRV\t10 10 8080 db.sub.example.com.",
+		"_http._tcp.sub.example.com.\t60\tIN\tSRV\t10 10 8080 web.sub.example.com.",
+		"_postgres._tcp.sub.example.com.\t60\tIN\tSRV\t10 10 5432 db.sub.example.com.",
+		"app.sub.example.com.\t60\tIN\tCNAME\tweb.sub.example.com.",
+		"db.sub.example.com.\t60\tIN\tA\t100.64.0.3",
+		"frontend.sub.example.com.\t60\tIN\tA\t100.64.0.2",
+		"frontend.sub.example.com.\t60\tIN\tA\t100.64.0.4",
+		"frontend.sub.example.com.\t60\tIN\tA\t100.100.0.4",
+		"frontend.sub.example.com.\t60\tIN\tAAAA\tfd7a:115c:a1e0::2",
+		"frontend.sub.example.com.\t60\tIN\tAAAA\tfd7a:115c:a1e0::4",
+		"frontend.sub.example.com.\t60\tIN\tAAAA\tfd7a:115c:a1e0::5",
+		"ts-dns.sub.example.com.\t60\tIN\tA\t100.64.0.1",
+		"ts-dns.sub.example.com.\t60\tIN\tAAAA\tfd7a:115c:a1e0::1",
+		"vip.sub.example.com.\t60\tIN\tA\t100.64.0.4",
+		"vip.sub.example.com.\t60\tIN\tA\t100.100.0.4",
+		"vip.sub.example.com.\t60\tIN\tAAAA\tfd7a:115c:a1e0::4",
+		"vip.sub.example.com.\t60\tIN\tAAAA\tfd7a:115c:a1e0::5",
+		"web.sub.example.com.\t60\tIN\tA\t100.64.0.2",
+		"web.sub.example.com.\t60\tIN\tAAAA\tfd7a:115c:a1e0::2",
+		soa,
+	}
+
+	ch, err := ts.Transfer("sub.example.com.", 0)
+	got := collect(t, ch, err)
+	if len(got) != len(expected) {
+		t.Fatalf("Expected %d records but got %d: %v", len(expected), len(got), got)
+	}
+	for i := range expected {
+		if got[i] != expected[i] {
+			t.Errorf("Expected record %d to be %q but got %q", i, expected[i], got[i])
+		}
+	}
+
+	// Names of sub.example.com are not part of example.com
+	ch, err = ts.Transfer("example.com.", 0)
+	for _, rr := range collect(t, ch, err) {
+		if owner := strings.Fields(rr)[0]; dns.IsSubDomain("sub.example.com.", owner) {
+			t.Errorf("Unexpected record %q in example.com", rr)
+		}
+	}
+
+	// An IXFR for the current serial only gets the SOA
+	ch, err = ts.Transfer("sub.example.com.", 1234)
+	if got := collect(t, ch, err); len(got) != 1 || got[0] != soa {
+		t.Errorf("Expected only the SOA but got %v", got)
+	}
+
+	// An IXFR for an older serial falls back to a full transfer
+	ch, err = ts.Transfer("sub.example.com.", 1000)
+	if got := collect(t, ch, err); len(got) != len(expected) {
+		t.Errorf("Expected %d records but got %d", len(expected), len(got))
+	}
+
+	if _, err := ts.Transfer("example.org.", 0); !errors.Is(err, transfer.ErrNotAuthoritative) {
+		t.Errorf("Expected ErrNotAuthoritative but got %v", err)
+	}
+}
+
+// testNotifier records the zones it was asked to notify.
+type testNotifier struct {
+	zones chan string
+}
+
+func (n *testNotifier) Notify(zone string) error {
+	n.zones <- zone
+	return nil
+}
+
+func TestNotify(t *testing.T) {
+	n := &testNotifier{zones: make(chan string, 10)}
+	ts := newTailscale([]string{"example.com", "example.org"})
+	ts.notifier = n
+
+	expectNotified := func(expected []string) {
+		t.Helper()
+		var got []string
+		for range expected {
+			select {
+			case zone := <-n.zones:
+				got = append(got, zone)
+			case <-time.After(time.Second):
+				t.Fatalf("Expected notifies for %v but got %v", expected, got)
+			}
+		}
+		slices.Sort(got)
+		if !slices.Equal(got, expected) {
+			t.Errorf("Expected notifies for %v but got %v", expected, got)
+		}
+	}
+
+	ts.update(testStatus())
+	expectNotified([]string{"example.com.", "example.org."})
+
+	// Unchanged records are not announced
+	ts.update(testStatus())
+	select {
+	case zone := <-n.zones:
+		t.Errorf("Unexpected notify for %s", zone)
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	status := testStatus()
+	status.Self.HostName = "ns1"
+	ts.update(status)
+	expectNotified([]string{"example.com.", "example.org."})
+}
@@ -0,0 +1,64 @@
+package plugin
+
+import (
+	"context"
+	"time"
+
+	clog "github.com/coredns/coredns/plugin/pkg/log"
+	"tailscale.com/ipn"
+)
+
+const (
+	// changeSettleDelay is how long a refresh waits after a netmap change, so
+	// that a burst of notifications results in a single status read.
+	changeSettleDelay = 500 * time.Millisecond
+
+	// watchRetryInterval is the delay before the notification bus is watched
+	// again after an error, for example while tailscaled restarts.
+	watchRetryInterval = 5 * time.Second
+)
+
+// watchIPNBus follows the tailscaled notification bus and requests a refresh
+// whenever the network map changes, until ctx is done. Periodic polling keeps
+// running as a safety net for missed notifications.
+func (r *refresher) watchIPNBus(ctx context.Context) {
+	for {
+		err := r.watchIPNBusOnce(ctx)
+		if ctx.Err() != nil {
+			return
+		}
+		clog.Warningf("lost tailscaled notification bus, retrying in %s: %v", watchRetryInterval, err)
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(watchRetryInterval):
+		}
+	}
+}
+
+// watchIPNBusOnce watches the notification bus until it fails.
+func (r *refresher) watchIPNBusOnce(ctx context.Context) error {
+	watcher, err := r.lc.WatchIPNBus(ctx, ipn.NotifyNoPrivateKeys)
+	if err != nil {
+		return err
+	}
+	defer watcher.Close()
+
+	clog.Info("watching tailscaled for network map changes")
+	for {
+		n, err := watcher.Next()
+		if err != nil {
+			return err
+		}
+		r.handleNotify(n)
+	}
+}
+
+// handleNotify requests a refresh for notifications that may change the
+// published records.
+func (r *refresher) handleNotify(n ipn.Notify) {
+	if n.NetMap != nil || n.State != nil {
+		r.requestRefresh()
+	}
+}
@@ -0,0 +1,26 @@
+package plugin
+
+import (
+	"testing"
+
+	"tailscale.com/ipn"
+	"tailscale.com/types/netmap"
+)
+
+func TestHandleNotify(t *testing.T) {
+	r := &refresher{changed: make(chan struct{}, 1)}
+
+	r.handleNotify(ipn.Notify{Version: "1.68.2"})
+	if len(r.changed) != 0 {
+		t.Fatalf("Expected no refresh for a notification without changes")
+	}
+
+	// A burst of changes results in a single pending refresh
+	state := ipn.Running
+	r.handleNotify(ipn.Notify{NetMap: &netmap.NetworkMap{}})
+	r.handleNotify(ipn.Notify{NetMap: &netmap.NetworkMap{}})
+	r.handleNotify(ipn.Notify{State: &state})
+	if len(r.changed) != 1 {
+		t.Errorf("Expected 1 pending refresh but got %d", len(r.changed))
+	}
+}
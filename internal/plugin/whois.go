@@ -0,0 +1,86 @@
+package plugin
+
+import (
+	"context"
+	"net/netip"
+	"sync"
+	"time"
+
+	clog "github.com/coredns/coredns/plugin/pkg/log"
+	"tailscale.com/client/tailscale/apitype"
+)
+
+// Identities of query sources are cached for whoisCacheTTL, and at most
+// whoisCacheSize of them are kept.
+const (
+	whoisCacheTTL  = 30 * time.Second
+	whoisCacheSize = 4096
+)
+
+// whoisFunc looks up the tailnet identity behind an address, like
+// LocalClient.WhoIs.
+type whoisFunc func(ctx context.Context, addr string) (*apitype.WhoIsResponse, error)
+
+// whoisEntry is a cached identity.
+type whoisEntry struct {
+	who     *apitype.WhoIsResponse
+	expires time.Time
+}
+
+// whoisCache caches the identities of query sources.
+type whoisCache struct {
+	lookup  whoisFunc
+	mu      sync.Mutex
+	entries map[netip.Addr]whoisEntry
+}
+
+// newWhoisCache returns an empty cache resolving identities with lookup.
+func newWhoisCache(lookup whoisFunc) *whoisCache {
+	return &whoisCache{lookup: lookup, entries: make(map[netip.Addr]whoisEntry)}
+}
+
+// identify returns the identity of the node using addr, or nil when addr is
+// not a tailnet address or tailscaled does not know it. Failed lookups are not
+// cached.
+func (c *whoisCache) identify(ctx context.Context, addr netip.Addr) *apitype.WhoIsResponse {
+	addr = addr.Unmap()
+	if !isTailnetIP(addr) {
+		return nil
+	}
+
+	now := time.Now()
+	c.mu.Lock()
+	entry, ok := c.entries[addr]
+	c.mu.Unlock()
+	if ok && now.Before(entry.expires) {
+		return entry.who
+	}
+
+	who, err := c.lookup(ctx, addr.String())
+	if err != nil {
+		clog.Debugf("failed to identify %s: %v", addr, err)
+		return nil
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if len(c.entries) >= whoisCacheSize {
+		for cached, entry := range c.entries {
+			if !now.Before(entry.expires) {
+				delete(c.entries, cached)
+			}
+		}
+		if len(c.entries) >= whoisCacheSize {
+			clear(c.entries)
+		}
+	}
+	c.entries[addr] = whoisEntry{who: who, expires: now.Add(whoisCacheTTL)}
+	return who
+}
+
+// clear drops every cached identity.
+func (c *whoisCache) clear() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	clear(c.entries)
+}
@@ -11,6 +11,12 @@ import (
 
 const corefileTemplate = `. {
     tailscale {{ .DomainsString }}
+{{- if .TailscaleOptions }} {
+{{- range .TailscaleOptions }}
+        {{ . }}
+{{- end }}
+    }
+{{- end }}
 {{- if .HostsFile }}
     hosts {{ .HostsFile }} {
         fallthrough
@@ -33,6 +39,7 @@ const corefileTemplate = `. {
 // CorefileData represents the data used to generate the Corefile
 type CorefileData struct {
 	DomainsString    string
+	TailscaleOptions []string
 	HostsFile        string
 	ForwardTo        string
 	RewriteRules     string
@@ -71,8 +78,21 @@ func (g *Generator) GenerateCorefile(cfg *config.Config) (string, error) {
 		rewriteRules = loadedRules
 	}
 
+	// Build the tailscale plugin block
+	var tailscaleOptions []string
+	if cfg.Fallthrough {
+		tailscaleOptions = append(tailscaleOptions, strings.TrimSpace("fallthrough "+strings.Join(cfg.FallthroughZones, " ")))
+	}
+	if cfg.SnapshotFile != "" {
+		tailscaleOptions = append(tailscaleOptions, "snapshot "+cfg.SnapshotFile)
+	}
+	if len(cfg.DNSSECKeys) > 0 {
+		tailscaleOptions = append(tailscaleOptions, "dnssec "+strings.Join(cfg.DNSSECKeys, " "))
+	}
+
 	data := CorefileData{
 		DomainsString:    domainsString,
+		TailscaleOptions: tailscaleOptions,
 		HostsFile:        cfg.HostsFile,
 		ForwardTo:        cfg.ForwardTo,
 		RewriteRules:     strings.TrimSpace(rewriteRules),
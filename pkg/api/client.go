@@ -5,6 +5,7 @@ import (
 	"context"
 	"encoding/json"
 	"fmt"
+	"io"
 	"net/http"
 	"net/url"
 	"os"
@@ -123,6 +124,41 @@ func (a *Client) GetSplitDNS(ctx context.Context) (SplitDNSConfig, error) {
 	return splitDNS, nil
 }
 
+// GetPolicy retrieves the tailnet policy file as JSON
+func (a *Client) GetPolicy(ctx context.Context) ([]byte, error) {
+	token, err := a.getAccessToken(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get access token: %w", err)
+	}
+
+	url := fmt.Sprintf("https://api.tailscale.com/api/v2/tailnet/%s/acl", a.tailnet)
+	req, err := http.NewRequestWithContext(ctx, "GET", url, nil)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create request: %w", err)
+	}
+
+	req.Header.Set("Authorization", "Bearer "+token)
+	// Ask for plain JSON instead of HuJSON with comments
+	req.Header.Set("Accept", "application/json")
+
+	resp, err := a.httpClient.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get policy: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("get policy failed with status: %d", resp.StatusCode)
+	}
+
+	policy, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read policy response: %w", err)
+	}
+
+	return policy, nil
+}
+
 // PatchSplitDNS performs a partial update of split DNS configuration
 func (a *Client) PatchSplitDNS(ctx context.Context, updates SplitDNSConfig) error {
 	token, err := a.getAccessToken(ctx)